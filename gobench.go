@@ -3,21 +3,46 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	neturl "net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/pborman/uuid"
@@ -27,6 +52,7 @@ import (
 // Global variables
 var (
 	requests         int64
+	totalRequests    int64
 	period           int64
 	clients          int
 	url              string
@@ -43,6 +69,127 @@ var (
 	verbose          bool
 	contentType      string
 	uriSubstitution  bool
+	minTLS           string
+	maxTLS           string
+	sniName          string
+	hostHeader       string
+	rate             float64
+	arrival          string
+	stopOnStatus     intList
+	captureHeaders   stringList
+	chunked          bool
+	expectContinue   bool
+	latencyUnit      string
+	jsonOutput       bool
+	baselinePath     string
+	stepsSpec        string
+	repeatCount      int
+	findMaxRate      bool
+	targetP99        time.Duration
+	probeDuration    time.Duration
+	grpcMode         bool
+	grpcMethod       string
+	wsMode           bool
+	wsMessage        string
+	wsCount          int
+	wsInterval       time.Duration
+	keepAliveReqs    int64
+	maxResponseSize  int
+	readBufferSize   int
+	discardBody      bool
+	warmupRequests   int64
+	logFailuresPath  string
+	logFailuresMax   int
+	cacheBust        bool
+	contentLength    int
+	replayPath       string
+	replayLoop       bool
+	bodyTemplatePath string
+	urlTemplateText  string
+	maxDuration      time.Duration
+	hostsList        string
+	hostSelect       string
+	connsPerHost     int
+	ipVersion        string
+	summaryOutPath   string
+	honorRetryAfter  bool
+	maxRetryAfter    time.Duration
+	dnsTimeout       time.Duration
+	backend          string
+	phases           bool
+	maxMemory        int
+	outputTemplate   string
+	forceBody        bool
+	tcpKeepAlive     time.Duration
+	schemaPath       string
+	bodyRegex        string
+	thinkTime        time.Duration
+	thinkDist        string
+	thinkMin         time.Duration
+	thinkMax         time.Duration
+	thinkStddev      time.Duration
+	normalizeURLs    string
+	rateStart        float64
+	rateEnd          float64
+	rampMaxErrors    float64
+	configPath       string
+	saveConfigPath   string
+	autoConcurrency  bool
+	maxBodyPrint     int
+	errorBackoff     time.Duration
+	rateBasis        string
+	failFastConnect  int64
+	delaySampleRate  float64
+	windowCSVPath    string
+	windowLength     time.Duration
+	getBody          bool
+	clipPercentile   float64
+	warnSlow         time.Duration
+	runtimeStats     bool
+	proxyList        string
+	proxyFile        string
+	weightsPath      string
+	firstByteTimeout time.Duration
+	reportReused     bool
+	snapshotSignal   bool
+	seed             int64
+	clientRate       float64
+	precision        int
+	requestTimeout   time.Duration
+	expectSHA256     string
+	rpsTarget        float64
+	logLevelName     string
+	gzipDataPath     string
+	maxSamples       int64
+	failOnNetErrors  bool
+	extractFlags     stringList
+	keepErrSamples   int
+	multipartSize    int64
+	errorsByURL      bool
+	checkOnly        bool
+	workerAddr       string
+	workersList      string
+	workerToken      string
+	summaryLatencies bool
+	perClient        bool
+	gzipResponses    bool
+	minLatency       time.Duration
+	connStrategy     string
+	influxPath       string
+	influxURL        string
+	influxInterval   time.Duration
+	runLabel         string
+	statsdAddr       string
+	statsdSample     float64
+	gracefulDrain    bool
+	drainTimeout     time.Duration
+	randHeaderFlags  stringList
+	noLatency        bool
+	connSummary      bool
+	localAddrs       string
+	bodyRepeat       int
+	reportFormat     string
+	idempotencyHdr   string
 )
 
 // Benchmark Client Configuration
@@ -51,6 +198,7 @@ type Configuration struct {
 	method          string
 	postData        []byte
 	requests        int64
+	totalRequests   int64
 	period          int64
 	keepAlive       bool
 	authHeader      string
@@ -58,8 +206,291 @@ type Configuration struct {
 	randomize       bool
 	contentType     string
 	uriSubstitution bool
+	hostHeader      string
+	rate            float64
+	arrival         string
+	stopOnStatus    map[int]bool
+	captureHeaders  []string
+	chunked         bool
+	expectContinue  bool
+	steps           []step
+	grpc            bool
+	websocket       bool
+	keepAliveReqs   int64
+	discardBody     bool
+	warmupRequests  int64
+	failureLog      *failureLog
+	cacheBust       bool
+	contentLength   int
+	replay          *replayLog
+	bodyTemplate    *template.Template
+	urlTemplate     *template.Template
+	hosts           []string
+	randomHosts     bool
+	honorRetryAfter bool
+	maxRetryAfter   time.Duration
+	netHTTP         bool
+	phases          bool
+	forceBody       bool
+	schema          *jsonSchema
+	bodyRegex       *regexp.Regexp
+	thinkDist       string
+	thinkTime       time.Duration
+	thinkMin        time.Duration
+	thinkMax        time.Duration
+	thinkStddev     time.Duration
+	routePattern    *regexp.Regexp
+	rateStart       float64
+	rateEnd         float64
+	rampDuration    time.Duration
+	errorBackoff    time.Duration
+	failFastConnect int64
+	getBody         bool
+	warnSlow        time.Duration
+	minLatency      time.Duration
+	urlWeights      []float64 // cumulative, by index of urls
+	ttfbTimeout     time.Duration
+	clientRate      float64
+	requestTimeout  time.Duration
+	bodySHA256      []byte
+	rpsTarget       float64
+	contentEnc      string
+	maxSamples      int64
+	extracts        []extraction
+	multipartSize   int64
+	errorsByURL     bool
+	check           bool
+	gzip            bool
+	statsd          *statsdClient
+	randomHeaders   []header
 
-	myClient fasthttp.Client
+	myClient   fasthttp.Client
+	grpcClient *http.Client
+	httpClient *http.Client
+
+	// connSlots queues the fasthttp requests for the -conns-per-host
+	// connections, set with -conns-per-host only
+	connSlots *slotDoer
+
+	// clientConns holds the clients of -conn-strategy per-client, nil
+	// when the clients share a pool
+	clientConns *clientConns
+}
+
+// requestDoer sends one request and reads its response, like
+// fasthttp.Client
+type requestDoer interface {
+	Do(req *fasthttp.Request, resp *fasthttp.Response) error
+}
+
+// doer is the client the fasthttp requests are sent with
+func (c *Configuration) doer() requestDoer {
+	if c.connSlots != nil {
+		return c.connSlots
+	}
+	return &c.myClient
+}
+
+// clientDoer is the client the fasthttp requests of the client clientID
+// are sent with: its own one with -conn-strategy per-client, otherwise the
+// shared one of doer
+func (c *Configuration) clientDoer(clientID int) requestDoer {
+	if c.clientConns != nil {
+		return c.clientConns.fasthttp(clientID)
+	}
+	return c.doer()
+}
+
+// netHTTPClient is the net/http counterpart of clientDoer
+func (c *Configuration) netHTTPClient(clientID int) *http.Client {
+	if c.clientConns != nil {
+		return c.clientConns.netHTTP(clientID)
+	}
+	return c.httpClient
+}
+
+// clientConns gives each client its own fasthttp or net/http client, of a
+// single connection per host, so that no two clients ever share a
+// connection. The clients are made on their first request, with the
+// settings of base, as steps and -auto-concurrency add clients on the way.
+type clientConns struct {
+	base *fasthttp.Client
+
+	mu       sync.Mutex
+	fast     map[int]*fasthttp.Client
+	standard map[int]*http.Client
+}
+
+func newClientConns(base *fasthttp.Client) *clientConns {
+	return &clientConns{base: base, fast: make(map[int]*fasthttp.Client), standard: make(map[int]*http.Client)}
+}
+
+func (c *clientConns) fasthttp(clientID int) *fasthttp.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client := c.fast[clientID]
+	if client == nil {
+		client = &fasthttp.Client{
+			Name:                c.base.Name,
+			ReadTimeout:         c.base.ReadTimeout,
+			WriteTimeout:        c.base.WriteTimeout,
+			MaxResponseBodySize: c.base.MaxResponseBodySize,
+			ReadBufferSize:      c.base.ReadBufferSize,
+			StreamResponseBody:  c.base.StreamResponseBody,
+			TLSConfig:           c.base.TLSConfig,
+			Dial:                c.base.Dial,
+			MaxConnsPerHost:     1,
+		}
+		c.fast[clientID] = client
+	}
+	return client
+}
+
+func (c *clientConns) netHTTP(clientID int) *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client := c.standard[clientID]
+	if client == nil {
+		client = newNetHTTPClient(1)
+		c.standard[clientID] = client
+	}
+	return client
+}
+
+// slotDoer sends requests with a requestDoer once it holds one of the size
+// slots of their host, a slot per connection. Clients beyond the connections
+// then queue here, where their wait is timed, rather than in the pool of the
+// client. A request that can't get a slot within timeout fails the way the
+// pool fails it, with fasthttp.ErrNoFreeConns.
+type slotDoer struct {
+	requestDoer
+	size    int
+	timeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newSlotDoer(doer requestDoer, size int, timeout time.Duration) *slotDoer {
+	return &slotDoer{requestDoer: doer, size: size, timeout: timeout, hosts: make(map[string]chan struct{})}
+}
+
+func (d *slotDoer) Do(req *fasthttp.Request, resp *fasthttp.Response) error {
+	slots := d.slots(string(req.URI().Host()))
+
+	start := time.Now()
+	var expired <-chan time.Time
+	if d.timeout > 0 {
+		timer := time.NewTimer(d.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-expired:
+		recordQueueWait(time.Since(start))
+		return fasthttp.ErrNoFreeConns
+	}
+	recordQueueWait(time.Since(start))
+	defer func() { <-slots }()
+
+	return d.requestDoer.Do(req, resp)
+}
+
+// slots returns the slots of host, made on its first request
+func (d *slotDoer) slots(host string) chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	slots := d.hosts[host]
+	if slots == nil {
+		slots = make(chan struct{}, d.size)
+		d.hosts[host] = slots
+	}
+	return slots
+}
+
+// how long the requests waited for a -conns-per-host connection, in
+// seconds, guarded by queueMu. With -max-samples, queueSamples is a
+// reservoir of at most that many of the queueSeen waits, drawn with
+// queueRand, which follows -seed.
+var queueMu sync.Mutex
+var queueSamples []float64
+var queueSeen int64
+var queueRand *rand.Rand
+
+func recordQueueWait(wait time.Duration) {
+	if !keepSamples() {
+		return
+	}
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	queueSeen++
+	if maxSamples > 0 && int64(len(queueSamples)) >= maxSamples {
+		// Algorithm R, as recordLatency does
+		if queueRand == nil {
+			source := time.Now().UnixNano()
+			if seed != 0 {
+				source = seed
+			}
+			queueRand = rand.New(rand.NewSource(source))
+		}
+		if i := queueRand.Int63n(queueSeen); i < maxSamples {
+			queueSamples[i] = wait.Seconds()
+		}
+		return
+	}
+	queueSamples = append(queueSamples, wait.Seconds())
+}
+
+// statsdClient sends a sampled share of the requests to a StatsD server:
+// counters of the requests and their outcome, and a timer of the latency.
+// Each request is a single datagram, and send errors are ignored, like
+// StatsD does for UDP.
+type statsdClient struct {
+	conn   net.Conn
+	sample float64
+}
+
+func newStatsdClient(addr string, sample float64) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{conn: conn, sample: sample}, nil
+}
+
+// send counts a completed request of status, the grpc-status for gRPC
+// calls, unless it failed with err
+func (c *statsdClient) send(configuration *Configuration, status int, latency time.Duration, err error) {
+	if c.sample < 1 && rand.Float64() >= c.sample {
+		return
+	}
+
+	rate := ""
+	if c.sample < 1 {
+		rate = fmt.Sprintf("|@%g", c.sample)
+	}
+
+	// gRPC calls succeed with status 0, HTTP requests with 200
+	outcome := "bad_failed"
+	if err != nil {
+		outcome = "network_failed"
+	} else if (configuration.grpc && status == 0) || (!configuration.grpc && status == http.StatusOK) {
+		outcome = "success"
+	} else if !configuration.grpc && isRedirect(status) {
+		outcome = "redirects"
+	}
+
+	packet := fmt.Sprintf("gobench.requests:1|c%s\ngobench.%s:1|c%s", rate, outcome, rate)
+	// requests aren't timed with -no-latency
+	if !noLatency {
+		packet += fmt.Sprintf("\ngobench.latency:%f|ms%s", float64(latency)/float64(time.Millisecond), rate)
+	}
+	c.conn.Write([]byte(packet))
 }
 
 type Result struct {
@@ -68,61 +499,6674 @@ type Result struct {
 	networkFailed int64
 	badFailed     int64
 	elapse        []float64
+
+	// the latencies of the client in the current -window-csv and
+	// -influx-interval windows
+	windowShard *windowShard
+	influxShard *windowShard
+
+	// 411 Length Required responses to chunked requests
+	chunkedRejected int64
+
+	// -ws failures to open a connection and to echo a message
+	wsConnectFailed int64
+	wsMessageFailed int64
+
+	// connections closed by -keepalive-requests
+	reconnects int64
+
+	// responses dropped for exceeding -max-response-size
+	bodyTooLarge int64
+
+	// requests issued during -warmup-requests, not counted anywhere else
+	warmup int64
+
+	// requests that gave up waiting for a free -conns-per-host connection
+	connQueueTimeouts int64
+
+	// responses faster than -min-expected-latency
+	tooFast int64
+
+	// 429 responses the client waited on with -honor-retry-after
+	throttled int64
+
+	// latencies not kept in elapse once -max-memory was reached
+	samplesDropped int64
+
+	// with -max-memory, every latency of the client counted in the buckets
+	// of the summary histogram, and the largest one, which stay small
+	// however long the run
+	histogram  []int64
+	latencyMax float64
+
+	// with -max-samples, elapse is a reservoir of at most this many of the
+	// samplesSeen latencies of the client
+	reservoir   int64
+	samplesSeen int64
+
+	// 200 responses whose body failed -schema, -expect-body-regex or
+	// -expect-sha256
+	assertionFailed int64
+
+	// time spent pausing after failed requests with -error-backoff
+	backoff time.Duration
+
+	// 3xx responses, which are not followed, counted apart from failures
+	redirects int64
+
+	// network failures where no response byte came within -first-byte-timeout
+	ttfbTimeout int64
+
+	// network failures that took longer than -timeout in all
+	timedOut int64
+
+	// held by the client while it records its requests and let go while it
+	// waits for the next one, so that -snapshot-on-signal reads the result
+	// in between
+	recordMu sync.Mutex
+
+	// header name -> header value -> responses, guarded by mu since the
+	// results can be printed while clients are still running
+	mu              sync.Mutex
+	capturedHeaders map[string]map[string]int64
+
+	// per target stats (such as per -hosts host), also guarded by mu
+	targets map[string]*TargetStats
+
+	// per route stats of -normalize-urls, also guarded by mu
+	routes map[string]*TargetStats
+
+	// per URL stats of -report-errors-by-url, also guarded by mu
+	urls map[string]*TargetStats
+
+	// -phases samples in seconds by phase name, also guarded by mu
+	phases map[string][]float64
+
+	// network failures by networkErrorKind, also guarded by mu
+	networkErrors map[string]int64
+}
+
+// failed is the number of failed requests of any kind
+func (r *Result) failed() int64 {
+	return r.networkFailed + r.badFailed + r.assertionFailed
+}
+
+// TargetStats are the counts of the requests sent to one target
+type TargetStats struct {
+	Requests int64   `json:"requests"`
+	Success  int64   `json:"success"`
+	Failed   int64   `json:"failed"`
+	Latency  float64 `json:"latency,omitempty"` // total, in seconds, none with -no-latency
+
+	// failures by kind, with -report-errors-by-url
+	Errors map[string]int64 `json:"errors,omitempty"`
+}
+
+func (t *TargetStats) add(other *TargetStats) {
+	t.Requests += other.Requests
+	t.Success += other.Success
+	t.Failed += other.Failed
+	t.Latency += other.Latency
+	for kind, count := range other.Errors {
+		if t.Errors == nil {
+			t.Errors = make(map[string]int64)
+		}
+		t.Errors[kind] += count
+	}
+}
+
+// recordTarget counts one request to target in result
+func recordTarget(result *Result, target string, ok bool, latency time.Duration) {
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	if result.targets == nil {
+		result.targets = make(map[string]*TargetStats)
+	}
+	countRequest(result.targets, target, ok, latency)
+}
+
+// recordRoute counts one request to the -normalize-urls route in result
+func recordRoute(result *Result, route string, ok bool, latency time.Duration) {
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	if result.routes == nil {
+		result.routes = make(map[string]*TargetStats)
+	}
+	countRequest(result.routes, route, ok, latency)
+}
+
+// recordURL counts one request to uri in result, failure being the kind of
+// failure of the request or "" when it succeeded
+func recordURL(result *Result, uri string, failure string, latency time.Duration) {
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	if result.urls == nil {
+		result.urls = make(map[string]*TargetStats)
+	}
+	countRequest(result.urls, uri, failure == "", latency)
+	if failure != "" {
+		stats := result.urls[uri]
+		if stats.Errors == nil {
+			stats.Errors = make(map[string]int64)
+		}
+		stats.Errors[failure]++
+	}
+}
+
+// failureKind names how a request failed for -report-errors-by-url, "" when
+// it succeeded
+func failureKind(statusCode int, err error) string {
+	if err != nil {
+		return "network error: " + networkErrorKind(err)
+	}
+	if statusCode != http.StatusOK {
+		return fmt.Sprintf("status code %d", statusCode)
+	}
+	return ""
+}
+
+// countRequest adds one request to the stats of key in all
+func countRequest(all map[string]*TargetStats, key string, ok bool, latency time.Duration) {
+	stats := all[key]
+	if stats == nil {
+		stats = &TargetStats{}
+		all[key] = stats
+	}
+
+	stats.Requests++
+	if ok {
+		stats.Success++
+	} else {
+		stats.Failed++
+	}
+	stats.Latency += latency.Seconds()
 }
 
 var readThroughput int64
 var writeThroughput int64
 
+// response body bytes after decoding, with -gzip
+var decodedBytes int64
+
+// requests claimed so far against the global -n budget
+var issuedRequests int64
+
+// cancelling rootCtx aborts the whole run, while runCtx only covers the
+// current step of -steps (they are the same without steps). Cancelling
+// either makes every client stop after its current request.
+var rootCtx, abortRun = context.WithCancel(context.Background())
+var runCtx, stopRun = rootCtx, abortRun
+
+// intList is a flag.Value collecting a repeatable int flag
+type intList []int
+
+func (l *intList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *intList) Set(value string) error {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// maxRepeatedBody bounds the body -body-repeat builds, 1 GiB
+const maxRepeatedBody = 1 << 30
+
+// stringList is a flag.Value collecting a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 // connection
 type MyConn struct {
 	net.Conn
+
+	// when the current request started to be written, in Unix
+	// nanoseconds, to time 100 Continue responses
+	requestStart int64
+
+	// set once the connection was found dead by TCP keep-alive probes
+	pruned int32
+
+	// set by the first Close, which takes the connection off openConns
+	closed int32
+
+	// the -proxy the connection is tunneled through, which counts its
+	// requests, and whether a response is being read and the current
+	// request has failed. The first write after a response starts the next
+	// request, as the requests of a connection take turns with their
+	// responses. net/http reads and writes a connection from two
+	// goroutines, so these are only accessed atomically.
+	proxy         *proxy
+	responding    int32
+	requestFailed int32
+}
+
+// interim 100 Continue responses seen with -expect-continue, and the total
+// time (in nanoseconds) from writing the request to receiving them
+var continueResponses int64
+var continueDelay int64
+
+// connections closed because their TCP keep-alive probes went unanswered
+var keepAlivePruned int64
+
+func (this *MyConn) Read(b []byte) (n int, err error) {
+	len, err := this.Conn.Read(b)
+
+	if err == nil {
+		atomic.AddInt64(&readThroughput, int64(len))
+
+		if expectContinue && isContinueResponse(b[:len]) {
+			atomic.AddInt64(&continueResponses, 1)
+			atomic.AddInt64(&continueDelay, time.Now().UnixNano()-atomic.LoadInt64(&this.requestStart))
+		} else {
+			atomic.StoreInt32(&this.responding, 1)
+		}
+	} else {
+		this.checkPruned(err)
+		this.failRequest()
+	}
+
+	return len, err
+}
+
+func (this *MyConn) Write(b []byte) (n int, err error) {
+	if atomic.CompareAndSwapInt32(&this.responding, 1, 0) || atomic.LoadInt64(&this.requestStart) == 0 {
+		atomic.StoreInt32(&this.requestFailed, 0)
+		atomic.StoreInt64(&this.requestStart, time.Now().UnixNano())
+		if this.proxy != nil {
+			atomic.AddInt64(&this.proxy.stats.Requests, 1)
+		}
+	}
+
+	len, err := this.Conn.Write(b)
+
+	if err == nil {
+		atomic.AddInt64(&writeThroughput, int64(len))
+	} else {
+		this.checkPruned(err)
+		this.failRequest()
+	}
+
+	return len, err
+}
+
+// failRequest counts the request of a -proxy connection as failed, once,
+// when reading or writing it fails
+func (this *MyConn) failRequest() {
+	if this.proxy == nil || atomic.LoadInt64(&this.requestStart) == 0 {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&this.requestFailed, 0, 1) {
+		atomic.AddInt64(&this.proxy.stats.RequestsFailed, 1)
+	}
+}
+
+func (this *MyConn) Close() error {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		atomic.AddInt64(&openConns, -1)
+	}
+	return this.Conn.Close()
+}
+
+// connections open right now
+var openConns int64
+
+// how often sampleConnections samples openConns
+const connSampleInterval = 100 * time.Millisecond
+
+// the samples of openConns, guarded by connMu
+var connMu sync.Mutex
+var connSamples int64
+var connSum int64
+var connMin int64
+var connMax int64
+
+// sampleConnections samples the number of open connections for the whole
+// run, to show whether the pool grows, shrinks or thrashes
+func sampleConnections() {
+	ticker := time.NewTicker(connSampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		open := atomic.LoadInt64(&openConns)
+
+		connMu.Lock()
+		if connSamples == 0 || open < connMin {
+			connMin = open
+		}
+		if open > connMax {
+			connMax = open
+		}
+		connSum += open
+		connSamples++
+		connMu.Unlock()
+	}
+}
+
+// checkPruned counts the connection as pruned by keep-alive the first time
+// it fails with ETIMEDOUT, which read and write deadlines don't return
+func (this *MyConn) checkPruned(err error) {
+	if errors.Is(err, syscall.ETIMEDOUT) && atomic.CompareAndSwapInt32(&this.pruned, 0, 1) {
+		atomic.AddInt64(&keepAlivePruned, 1)
+	}
+}
+
+// isContinueResponse reports whether b starts with a 100 Continue status
+// line. fasthttp skips interim responses, so they are spotted on the wire.
+func isContinueResponse(b []byte) bool {
+	return len(b) >= 12 && bytes.HasPrefix(b, []byte("HTTP/1.")) && bytes.Equal(b[8:12], []byte(" 100"))
+}
+
+func init() {
+	flag.Int64Var(&requests, "r", -1, "Number of requests per client")
+	flag.Int64Var(&totalRequests, "n", -1, "Total number of requests, shared across all clients")
+	flag.IntVar(&clients, "c", 100, "Number of concurrent clients")
+	flag.StringVar(&url, "u", "", "URL")
+	flag.StringVar(&urlsFilePath, "f", "", "URL's file path (line seperated, blank lines and # comments are skipped)")
+	flag.BoolVar(&keepAlive, "k", true, "Do HTTP keep-alive")
+	flag.StringVar(&postDataFilePath, "d", "", "HTTP POST data file path")
+	flag.StringVar(&gzipDataPath, "dgz", "", "Gzipped HTTP POST data file path, sent as is with Content-Encoding: gzip")
+	flag.Int64Var(&period, "t", -1, "Period of time (in seconds)")
+	flag.IntVar(&writeTimeout, "tw", 5000, "Write timeout (in milliseconds)")
+	flag.IntVar(&readTimeout, "tr", 5000, "Read timeout (in milliseconds)")
+	flag.StringVar(&authHeader, "auth", "", "Authorization header")
+	flag.StringVar(&userAgent, "agent", "", "User-Agent header")
+	flag.StringVar(&acceptEnc, "accept", "", "Accept-Encoding header")
+	flag.BoolVar(&randomize, "random", false, "Randomize URL order")
+	flag.BoolVar(&insecure, "insecure", false, "Skip verifing SSL certificate")
+	flag.BoolVar(&verbose, "v", false, "Show debug messages")
+	flag.StringVar(&contentType, "ct", "", "Content type")
+	flag.BoolVar(&uriSubstitution, "s", false, "Support <UUID> & <CID> substition in uri")
+	flag.StringVar(&minTLS, "min-tls", "", "Minimum TLS version (1.0, 1.1, 1.2, 1.3)")
+	flag.StringVar(&maxTLS, "max-tls", "", "Maximum TLS version (1.0, 1.1, 1.2, 1.3)")
+	flag.StringVar(&sniName, "sni", "", "TLS server name (SNI) to present, instead of the URL host")
+	flag.StringVar(&hostHeader, "host", "", "Host header to send, instead of the URL host")
+	flag.Float64Var(&rate, "rate", 0, "Target request rate (requests/sec) across all clients, 0 for no limit")
+	flag.StringVar(&arrival, "arrival", "uniform", "Request arrival timing with -rate: uniform or poisson")
+	flag.Var(&stopOnStatus, "stop-on-status", "Stop the run the first time this status code is returned (repeatable)")
+	flag.Var(&captureHeaders, "capture-header", "Count the values returned for this response header (repeatable)")
+	flag.BoolVar(&chunked, "chunked", false, "Send the POST data with chunked transfer encoding")
+	flag.BoolVar(&expectContinue, "expect-continue", false, "Send an Expect: 100-continue header and count 100 Continue responses, timed from the start of the request. The body is sent without waiting for them.")
+	flag.BoolVar(&jsonOutput, "json", false, "Print the summary as JSON, short for -format json")
+	flag.StringVar(&reportFormat, "format", "text", "Format of the summary: text, json, csv or prometheus")
+	flag.StringVar(&baselinePath, "baseline", "", "JSON summary of a previous run (from -json) to compare against")
+	flag.StringVar(&stepsSpec, "steps", "", "Run steps of clients:duration one after another, e.g. 10:30s,50:30s,100:30s")
+	flag.IntVar(&repeatCount, "repeat", 1, "Run the benchmark this many times and report a stable estimate across the runs")
+	flag.BoolVar(&findMaxRate, "find-max-throughput", false, "Search for the highest rate up to -rate that keeps p99 under -target-p99")
+	flag.BoolVar(&autoConcurrency, "auto-concurrency", false, "Search for the most clients up to -c that keep p99 under -target-p99")
+	flag.DurationVar(&targetP99, "target-p99", 0, "p99 latency target for -find-max-throughput and -auto-concurrency")
+	flag.DurationVar(&probeDuration, "probe-duration", 10*time.Second, "Duration of each probing run of -find-max-throughput and -auto-concurrency")
+	flag.BoolVar(&grpcMode, "grpc", false, "Benchmark a unary gRPC call, -d holds the proto-encoded request message")
+	flag.StringVar(&grpcMethod, "grpc-method", "", "gRPC method to call with -grpc (package.Service/Method)")
+	flag.BoolVar(&wsMode, "ws", false, "Benchmark a WebSocket echo endpoint (ws:// or wss:// URL)")
+	flag.StringVar(&wsMessage, "ws-message", "hello", "Message to send with -ws")
+	flag.IntVar(&wsCount, "ws-count", 10, "Messages to send on each WebSocket connection before reconnecting")
+	flag.DurationVar(&wsInterval, "ws-interval", 0, "Pause between WebSocket messages")
+	flag.Int64Var(&keepAliveReqs, "keepalive-requests", 0, "Close the connection after this many requests of a client, 0 for no limit (counted per client, per connection only with -conn-strategy per-client)")
+	flag.IntVar(&maxResponseSize, "max-response-size", 0, "Maximum response body size in bytes, 0 for no limit")
+	flag.IntVar(&readBufferSize, "read-buffer", 0, "Per-connection read buffer size in bytes, also limits the response header size (0 for the fasthttp default)")
+	flag.BoolVar(&discardBody, "discard-body", false, "Stream response bodies into a discard buffer instead of keeping them in memory")
+	flag.Int64Var(&warmupRequests, "warmup-requests", 0, "Requests per client to send before recording any results")
+	flag.StringVar(&logFailuresPath, "log-failures", "", "Write failed requests and their responses to this file")
+	flag.IntVar(&logFailuresMax, "log-failures-max", 100, "Maximum number of failed requests to write with -log-failures")
+	flag.BoolVar(&cacheBust, "cache-bust", false, "Append a random _=<value> query parameter to every request")
+	flag.IntVar(&contentLength, "content-length", -1, "Content-Length to send instead of the real body size, for robustness testing")
+	flag.StringVar(&replayPath, "replay", "", "Replay the requests of a log file (lines of: method path) in order")
+	flag.BoolVar(&replayLoop, "replay-loop", false, "Start over at the top of the -replay log when it runs out")
+	flag.StringVar(&bodyTemplatePath, "body-template", "", "POST body Go template file, executed for every request")
+	flag.StringVar(&urlTemplateText, "url-template", "", "URL Go template executed for every request, paths are relative to -u")
+	flag.DurationVar(&maxDuration, "max-duration", 0, "Stop the run after this long even if requests are left, 0 for no limit")
+	flag.StringVar(&hostsList, "hosts", "", "Comma separated host[:port] list to spread the requests over, replacing the URL host")
+	flag.StringVar(&hostSelect, "host-select", "round-robin", "How -hosts are picked: round-robin or random")
+	flag.IntVar(&connsPerHost, "conns-per-host", 0, "Maximum connections per host, shared by all clients (0 for one per client)")
+	flag.StringVar(&ipVersion, "ipv", "auto", "IP version to connect over: 4, 6 or auto")
+	flag.StringVar(&summaryOutPath, "summary-out", "", "Also write the JSON summary to this file, replaced atomically")
+	flag.BoolVar(&summaryLatencies, "summary-latencies", false, "Add every latency sample (in seconds) to the -summary-out file, as a -worker does for its coordinator")
+	flag.BoolVar(&honorRetryAfter, "honor-retry-after", false, "On 429 responses wait for the Retry-After delay before the client's next request")
+	flag.DurationVar(&maxRetryAfter, "max-retry-after", time.Minute, "Longest Retry-After delay -honor-retry-after waits for, longer ones are cut to it, 0 for no cap")
+	flag.DurationVar(&dnsTimeout, "dns-timeout", 0, "Timeout for resolving the target host, 0 for no timeout")
+	flag.StringVar(&backend, "backend", "fasthttp", "HTTP client to send the requests with: fasthttp or net/http")
+	flag.BoolVar(&phases, "phases", false, "Report DNS, connect, TLS, TTFB and transfer latencies (needs -backend net/http)")
+	flag.IntVar(&maxMemory, "max-memory", 0, "Stop keeping latency samples once the heap grows past this many MB, 0 for no limit")
+	flag.StringVar(&outputTemplate, "output-template", "", "Go template file to print the summary with instead of the default layout")
+	flag.BoolVar(&forceBody, "force-body", false, "Send the POST data with every method, not only POST, PUT and PATCH")
+	flag.DurationVar(&tcpKeepAlive, "tcp-keepalive", 0, "TCP keep-alive probe period, dead connections are closed (0 for the Go default of 15s, negative to disable)")
+	flag.StringVar(&schemaPath, "schema", "", "JSON Schema file that the body of every 200 response must conform to")
+	flag.StringVar(&bodyRegex, "expect-body-regex", "", "Regular expression that the body of every 200 response must match")
+	flag.DurationVar(&thinkTime, "think", 0, "Think time of a client between two requests (the mean with -think-dist exponential or normal)")
+	flag.StringVar(&thinkDist, "think-dist", "constant", "Think time distribution: constant, uniform, exponential or normal")
+	flag.DurationVar(&thinkMin, "think-min", 0, "Shortest think time with -think-dist uniform")
+	flag.DurationVar(&thinkMax, "think-max", 0, "Longest think time with -think-dist uniform")
+	flag.DurationVar(&thinkStddev, "think-stddev", 0, "Standard deviation of the think time with -think-dist normal")
+	flag.StringVar(&normalizeURLs, "normalize-urls", "", "Report stats per route, the URL path with IDs replaced by {id}: auto, or a regular expression matching the IDs")
+	flag.Float64Var(&rateStart, "rate-start", 0, "Request rate (requests/sec) at the start of a ramp to -rate-end over the -t period")
+	flag.Float64Var(&rateEnd, "rate-end", 0, "Request rate (requests/sec) at the end of a ramp from -rate-start")
+	flag.Float64Var(&rampMaxErrors, "ramp-max-errors", 1, "Error rate (percent) over which a second of a rate ramp counts as failing")
+	flag.StringVar(&configPath, "config", "", "JSON file of flag values to run with, flags on the command line take precedence")
+	flag.StringVar(&saveConfigPath, "save-config", "", "Write the flag values of this run (other than defaults) to a JSON file for -config")
+	flag.IntVar(&maxBodyPrint, "max-body-print", 1024, "Longest body in bytes to write out with -log-failures and -keep-errors-sample, longer ones are cut (0 for no limit)")
+	flag.DurationVar(&errorBackoff, "error-backoff", 0, "Pause a client for this long after each of its failed requests")
+	flag.StringVar(&rateBasis, "rate-basis", "success", "Requests the headline rate counts, in comparisons, steps and repeats: success or total")
+	flag.Int64Var(&failFastConnect, "fail-fast-connect", 0, "Exit early if this many first requests all fail to connect, 0 to never give up")
+	flag.Float64Var(&delaySampleRate, "sample-rate", 1, "Share of the request latencies to write to delay.txt, e.g. 0.01 for 1% (the summary still uses all of them)")
+	flag.StringVar(&windowCSVPath, "window-csv", "", "Write the latency percentiles of every -window of the run to this CSV file")
+	flag.DurationVar(&windowLength, "window", time.Minute, "Length of the windows of -window-csv")
+	flag.BoolVar(&getBody, "get-body", false, "Send the POST data (-d or -body-template) with GET requests instead, for APIs such as Elasticsearch search")
+	flag.Float64Var(&clipPercentile, "clip-percentile", 0, "Leave the latencies over this percentile (e.g. 99.9) out of the mean and stddev, 0 to keep them all")
+	flag.DurationVar(&warnSlow, "warn-slow", 0, "Log requests slower than this to stderr as they happen (at most 5 a second), 0 for none")
+	flag.BoolVar(&runtimeStats, "runtime-stats", false, "Add the goroutines, GOMAXPROCS and GC pauses of gobench itself to the summary")
+	flag.StringVar(&proxyList, "proxy", "", "Comma separated HTTP proxies ([user:pass@]host:port) to tunnel the connections through in turn")
+	flag.StringVar(&proxyFile, "proxy-file", "", "File of HTTP proxies, one per line, to use like -proxy")
+	flag.StringVar(&weightsPath, "weights", "", "File of url<TAB>weight lines to pick the URLs at random by weight (unlisted URLs weigh 1)")
+	flag.DurationVar(&firstByteTimeout, "first-byte-timeout", 0, "Fail requests with no response byte this long after they were sent, 0 for none (needs -backend net/http)")
+	flag.BoolVar(&reportReused, "report-connections-reused", false, "Report the connections opened and the share of requests sent on reused ones")
+	flag.BoolVar(&snapshotSignal, "snapshot-on-signal", false, "Print a summary of the run so far on SIGUSR1, without stopping it")
+	flag.Int64Var(&seed, "seed", 0, "Seed the random choices of the clients, <UUID> included, to repeat the same requests run after run (0 for a random seed)")
+	flag.Float64Var(&clientRate, "client-rate", 0, "Most requests per second of each client, on top of -rate, 0 for no limit")
+	flag.IntVar(&precision, "precision", 2, "Decimal places of the latencies in the summary")
+	flag.DurationVar(&requestTimeout, "timeout", 0, "Most time a request may take in all, connecting, writing and reading, 0 for no limit (bounds -tr and -tw)")
+	flag.StringVar(&expectSHA256, "expect-sha256", "", "SHA-256 (in hex) that the body of every 200 response must have")
+	flag.Float64Var(&rpsTarget, "rps-target", 0, "Request rate (requests/sec) to hold over the -t period, with as many of the -c clients as it takes")
+	flag.StringVar(&logLevelName, "log-level", "info", "Level of the diagnostics logged to stderr: error, warn, info or debug (-v is debug)")
+	flag.Int64Var(&maxSamples, "max-samples", 0, "Keep a uniform random sample of this many latencies for the percentiles, 0 to keep them all")
+	flag.BoolVar(&failOnNetErrors, "fail-on-network-errors", false, "Exit with status 1 if any request failed with a network error")
+	flag.Var(&extractFlags, "extract", "Set .Vars.NAME of the next templates of the client from each 200 response, given as \"json.path as NAME\" (repeatable)")
+	flag.IntVar(&keepErrSamples, "keep-errors-sample", 0, "Keep the first failed request of up to this many distinct failures and print them after the summary, 0 for none")
+	flag.Int64Var(&multipartSize, "multipart-stream", 0, "POST a multipart/form-data upload of a generated file this many bytes long, streamed without buffering it (fasthttp only)")
+	flag.BoolVar(&errorsByURL, "report-errors-by-url", false, "Report the failures of each URL by kind (by route with -normalize-urls)")
+	flag.BoolVar(&checkOnly, "check", false, "Send a single request, print it with the full response and exit without running the benchmark")
+	flag.StringVar(&workerAddr, "worker", "", "Run as a worker of -workers coordinators, listening on this address (such as :7070 for localhost only, 0.0.0.0:7070 for all interfaces)")
+	flag.StringVar(&workersList, "workers", "", "Comma separated host:port list of -worker instances to share the run out to, and merge the results of")
+	flag.StringVar(&workerToken, "worker-token", "", "Shared secret of a -worker and its -workers coordinators, required by both (default $GOBENCH_WORKER_TOKEN)")
+	flag.BoolVar(&perClient, "per-client", false, "Print the requests, success rate and mean latency of each client before the summary")
+	flag.StringVar(&idempotencyHdr, "idempotency-header", "", "Set this header (such as Idempotency-Key) to a new UUID on every request")
+	flag.IntVar(&bodyRepeat, "body-repeat", 1, "Send the -d body repeated this many times end to end, to build a large body from a small file")
+	flag.BoolVar(&connSummary, "connections-summary", false, "Report the distinct local ports the connections used, out of the ephemeral port range when known")
+	flag.StringVar(&localAddrs, "local-addr", "", "Comma separated local IP addresses to dial from in turn, each has its own ephemeral ports")
+	flag.BoolVar(&noLatency, "no-latency", false, "Don't time the requests nor keep latency samples, for the most throughput out of gobench: the summary has no latencies")
+	flag.Var(&randHeaderFlags, "random-header", "Set this header to a new random value on every request, or given as \"Name: value\" to value with <UUID> and <CID> substituted (repeatable)")
+	flag.BoolVar(&gracefulDrain, "graceful-drain", false, "When the run ends on -t or an interrupt, stop sending but wait up to -drain-timeout for the requests in flight before printing the results")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 10*time.Second, "Longest wait for the requests in flight with -graceful-drain, the ones left are counted as cancelled")
+	flag.StringVar(&statsdAddr, "statsd", "", "Send request counters and latency timers to this StatsD host:port over UDP as the run goes")
+	flag.Float64Var(&statsdSample, "statsd-sample", 1, "Share of the requests sent to -statsd, between 0 and 1, with the sample rate for StatsD to scale the counters back up")
+	flag.StringVar(&influxPath, "influx", "", "Write the summary as InfluxDB line protocol to this file at the end of the run")
+	flag.StringVar(&influxURL, "influx-url", "", "POST the -influx points to this InfluxDB write URL (such as http://localhost:8086/write?db=bench), with $INFLUX_TOKEN as the token if set")
+	flag.DurationVar(&influxInterval, "influx-interval", 0, "Add a point with the requests and latencies of every interval of this length to the -influx points, 0 for the summary only")
+	flag.StringVar(&runLabel, "label", "", "Name of the run, the label tag of the -influx points")
+	flag.StringVar(&connStrategy, "conn-strategy", "shared", "How clients map to connections: shared (one pool, up to a connection per client), per-client (a connection of its own per client) or pool:N (N connections per host, clients queue for them)")
+	flag.DurationVar(&minLatency, "min-expected-latency", 0, "Count and warn about responses faster than this, which likely didn't reach the backend (cache, mock or misrouting), 0 for none")
+	flag.BoolVar(&gzipResponses, "gzip", false, "Ask for gzip responses (Accept-Encoding: gzip) and decode them before checking, extracting or logging their bodies")
+	flag.StringVar(&latencyUnit, "latency-unit", "", "Unit for latencies in the summary and delay.txt: s, ms, us or ns (default ms in the summary, s in delay.txt)")
+}
+
+type timeUnit struct {
+	scale float64 // units per second
+	label string
+}
+
+// format formats seconds in the unit with -precision decimal places
+func (u timeUnit) format(seconds float64) string {
+	return fmt.Sprintf("%4.*f %s", precision, seconds*u.scale, u.label)
+}
+
+var timeUnits = map[string]timeUnit{
+	"s":  {1, "sec"},
+	"ms": {1e3, "msec"},
+	"us": {1e6, "usec"},
+	"ns": {1e9, "nsec"},
+}
+
+// Summary is the aggregate of a run, it is printed at the end and written
+// as JSON with -json. Latencies are in seconds.
+type Summary struct {
+	Requests          int64                       `json:"requests"`
+	Success           int64                       `json:"success"`
+	NetworkFailed     int64                       `json:"network_failed"`
+	BadFailed         int64                       `json:"bad_failed"`
+	Redirects         int64                       `json:"redirects"`
+	Rate              int64                       `json:"rate"` // per rate_basis
+	RateBasis         string                      `json:"rate_basis"`
+	SuccessRate       int64                       `json:"success_rate"`
+	TotalRate         int64                       `json:"total_rate"`
+	ReadThroughput    int64                       `json:"read_throughput"`
+	WriteThroughput   int64                       `json:"write_throughput"`
+	DecodedThroughput int64                       `json:"decoded_throughput,omitempty"`
+	Elapsed           int64                       `json:"elapsed"`
+	LatencyP50        float64                     `json:"latency_p50"`
+	LatencyP90        float64                     `json:"latency_p90"`
+	LatencyP99        float64                     `json:"latency_p99"`
+	LatencyMax        float64                     `json:"latency_max"`
+	LatencyMean       float64                     `json:"latency_mean"`   // clipped with clip_percentile
+	LatencyStddev     float64                     `json:"latency_stddev"` // clipped with clip_percentile
+	ClipPercentile    float64                     `json:"clip_percentile,omitempty"`
+	ClippedSamples    int64                       `json:"clipped_samples,omitempty"` // of latency_samples, the mean and stddev are over
+	LatencySamples    int64                       `json:"latency_samples,omitempty"`
+	ContinueResponses int64                       `json:"continue_responses,omitempty"`
+	ContinueDelay     float64                     `json:"continue_delay,omitempty"`
+	ChunkedRejected   int64                       `json:"chunked_rejected,omitempty"`
+	WSConnectFailed   int64                       `json:"ws_connect_failed,omitempty"`
+	WSMessageFailed   int64                       `json:"ws_message_failed,omitempty"`
+	Reconnects        int64                       `json:"reconnects,omitempty"`
+	BodyTooLarge      int64                       `json:"body_too_large,omitempty"`
+	WarmupRequests    int64                       `json:"warmup_requests,omitempty"`
+	ConnQueueTimeouts int64                       `json:"conn_queue_timeouts,omitempty"`
+	TooFast           int64                       `json:"too_fast,omitempty"`
+	Cancelled         int64                       `json:"cancelled,omitempty"`
+	NoLatency         bool                        `json:"no_latency,omitempty"`
+	LocalPorts        int64                       `json:"local_ports,omitempty"`
+	LocalPortsByIP    map[string]int64            `json:"local_ports_by_ip,omitempty"`
+	EphemeralPorts    int64                       `json:"ephemeral_ports,omitempty"`
+	TTFBTimeouts      int64                       `json:"ttfb_timeouts,omitempty"`
+	TimedOut          int64                       `json:"timed_out,omitempty"`
+	Throttled         int64                       `json:"throttled,omitempty"`
+	AssertionFailed   int64                       `json:"assertion_failed,omitempty"`
+	BackoffTime       float64                     `json:"backoff_time,omitempty"`
+	SamplesDropped    int64                       `json:"samples_dropped,omitempty"`
+	SamplesKept       int64                       `json:"samples_kept,omitempty"` // of samples_seen, with -max-samples
+	SamplesSeen       int64                       `json:"samples_seen,omitempty"`
+	KeepAlivePruned   int64                       `json:"keepalive_pruned,omitempty"`
+	ConnectionsMin    int64                       `json:"connections_min"`
+	ConnectionsMean   float64                     `json:"connections_mean"`
+	ConnectionsMax    int64                       `json:"connections_max"`
+	ConnectionsOpened int64                       `json:"connections_opened"`
+	ConnectionReuse   float64                     `json:"connection_reuse"` // % of requests on a reused connection
+	IPv4Connections   int64                       `json:"ipv4_connections"`
+	IPv6Connections   int64                       `json:"ipv6_connections"`
+	DNSLookups        int64                       `json:"dns_lookups"`
+	DNSFailures       int64                       `json:"dns_failures"`
+	QueueWaitP50      float64                     `json:"queue_wait_p50,omitempty"` // for a -conns-per-host connection
+	QueueWaitP90      float64                     `json:"queue_wait_p90,omitempty"`
+	QueueWaitP99      float64                     `json:"queue_wait_p99,omitempty"`
+	QueueWaitMax      float64                     `json:"queue_wait_max,omitempty"`
+	DNSP50            float64                     `json:"dns_p50"`
+	DNSP90            float64                     `json:"dns_p90"`
+	DNSP99            float64                     `json:"dns_p99"`
+	ClientRequestsMin int64                       `json:"client_requests_min"`
+	ClientRequestsMax int64                       `json:"client_requests_max"`
+	CapturedHeaders   map[string]map[string]int64 `json:"captured_headers,omitempty"`
+	Targets           map[string]*TargetStats     `json:"targets,omitempty"`
+	Routes            map[string]*TargetStats     `json:"routes,omitempty"`
+	URLs              map[string]*TargetStats     `json:"urls,omitempty"`
+	RampErrorsAt      float64                     `json:"ramp_errors_at,omitempty"`
+	RampLatencyAt     float64                     `json:"ramp_latency_at,omitempty"`
+	TargetRate        float64                     `json:"target_rate,omitempty"`
+	TargetHeld        float64                     `json:"target_held,omitempty"` // rate of the last seconds
+	TargetClients     int64                       `json:"target_clients,omitempty"`
+	Phases            map[string]*PhaseStats      `json:"phases,omitempty"`
+	Runtime           *RuntimeStats               `json:"runtime,omitempty"`
+	Proxies           map[string]ProxyStats       `json:"proxies,omitempty"`
+	NetworkErrors     map[string]int64            `json:"network_errors,omitempty"`
+	ErrorSamples      []ErrorSample               `json:"error_samples,omitempty"`
+	MultipartBytes    int64                       `json:"multipart_bytes,omitempty"`
+	LatencyHistogram  []HistogramBucket           `json:"latency_histogram,omitempty"`
+	LatencyStreamed   bool                        `json:"latency_streamed,omitempty"` // percentiles from the histogram of every request, with -max-memory
+	Latencies         []float64                   `json:"latencies,omitempty"`        // all samples, with -summary-latencies
+}
+
+// RuntimeStats describe the gobench process itself with -runtime-stats, to
+// tell whether the generator rather than the server was the bottleneck.
+// The GC numbers cover the whole process, not only the run.
+type RuntimeStats struct {
+	Goroutines    int     `json:"goroutines"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	NumCPU        int     `json:"num_cpu"`
+	NumGC         uint32  `json:"num_gc"`
+	GCPauseTotal  float64 `json:"gc_pause_total"` // seconds
+	GCPauseMax    float64 `json:"gc_pause_max"`   // seconds, of the last 256 pauses
+	GCCPUFraction float64 `json:"gc_cpu_fraction"`
+}
+
+// readRuntimeStats samples the runtime of the gobench process
+func readRuntimeStats() *RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := &RuntimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		NumCPU:        runtime.NumCPU(),
+		NumGC:         mem.NumGC,
+		GCPauseTotal:  time.Duration(mem.PauseTotalNs).Seconds(),
+		GCCPUFraction: mem.GCCPUFraction,
+	}
+	for _, pause := range mem.PauseNs {
+		if d := time.Duration(pause).Seconds(); d > stats.GCPauseMax {
+			stats.GCPauseMax = d
+		}
+	}
+	return stats
+}
+
+// PhaseStats are the latency percentiles of one request phase of -phases,
+// in seconds
+type PhaseStats struct {
+	Samples int64   `json:"samples"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+}
+
+// AverageLatency is the test time shared out over the successful
+// requests, in seconds
+func (s *Summary) AverageLatency() float64 {
+	return float64(s.Elapsed) / float64(s.Success)
+}
+
+// ErrorRate is the share of requests that failed, from 0 to 1
+func (s *Summary) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.NetworkFailed+s.BadFailed+s.AssertionFailed) / float64(s.Requests)
+}
+
+// percentile returns the nearest-rank p-th percentile (0-100) of sorted
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// histogramBase and histogramGrowth lay the buckets of the latency
+// histogram of the JSON summary out: bucket i holds the latencies up to
+// histogramBase*histogramGrowth^i seconds, 2% apart. All runs share the
+// buckets, so their summaries can be merged bucket by bucket.
+const (
+	histogramBase   = 1e-6
+	histogramGrowth = 1.02
+)
+
+// HistogramBucket counts the latencies over the bound of the bucket before
+// and up to Le seconds. Empty buckets are left out.
+type HistogramBucket struct {
+	Le    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+// histogramIndex returns the bucket of a latency in seconds
+func histogramIndex(latency float64) int {
+	if latency <= histogramBase {
+		return 0
+	}
+	return int(math.Ceil(math.Log(latency/histogramBase) / math.Log(histogramGrowth)))
+}
+
+// histogramBound returns the upper bound of bucket i, and bucketIndex the
+// bucket of such a bound, as read back from a summary
+func histogramBound(i int) float64 {
+	return histogramBase * math.Pow(histogramGrowth, float64(i))
+}
+
+func bucketIndex(le float64) int {
+	return int(math.Round(math.Log(le/histogramBase) / math.Log(histogramGrowth)))
+}
+
+// newHistogram buckets the sorted latencies rtts
+func newHistogram(rtts []float64) []HistogramBucket {
+	var buckets []HistogramBucket
+	last := -1
+	for _, rtt := range rtts {
+		if i := histogramIndex(rtt); i != last {
+			buckets = append(buckets, HistogramBucket{Le: histogramBound(i)})
+			last = i
+		}
+		buckets[len(buckets)-1].Count++
+	}
+	return buckets
+}
+
+// histogramPercentile returns the nearest-rank p-th percentile (0-100) of
+// the latencies of a histogram, as the bound of its bucket
+func histogramPercentile(buckets []HistogramBucket, p float64) float64 {
+	var total int64
+	for _, bucket := range buckets {
+		total += bucket.Count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(p / 100 * float64(total)))
+	var seen int64
+	for _, bucket := range buckets {
+		seen += bucket.Count
+		if seen >= rank {
+			return bucket.Le
+		}
+	}
+	return buckets[len(buckets)-1].Le
+}
+
+// meanStddev returns the mean and population standard deviation of values
+func meanStddev(values []float64) (mean, stddev float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+
+	for _, v := range values {
+		stddev += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(stddev / float64(len(values)))
+}
+
+func summarize(results map[int]*Result, startTime time.Time) *Summary {
+	summary := &Summary{
+		CapturedHeaders: make(map[string]map[string]int64),
+		Targets:         make(map[string]*TargetStats),
+		Routes:          make(map[string]*TargetStats),
+		URLs:            make(map[string]*TargetStats),
+		Phases:          make(map[string]*PhaseStats),
+		NetworkErrors:   make(map[string]int64),
+	}
+	var rtts []float64
+	phaseSamples := make(map[string][]float64)
+
+	summary.ClientRequestsMin = -1
+	for _, result := range results {
+		if summary.ClientRequestsMin == -1 || result.requests < summary.ClientRequestsMin {
+			summary.ClientRequestsMin = result.requests
+		}
+		if result.requests > summary.ClientRequestsMax {
+			summary.ClientRequestsMax = result.requests
+		}
+		summary.Requests += result.requests
+		summary.Success += result.success
+		summary.NetworkFailed += result.networkFailed
+		summary.BadFailed += result.badFailed
+		summary.Redirects += result.redirects
+		summary.ChunkedRejected += result.chunkedRejected
+		summary.WSConnectFailed += result.wsConnectFailed
+		summary.WSMessageFailed += result.wsMessageFailed
+		summary.Reconnects += result.reconnects
+		summary.BodyTooLarge += result.bodyTooLarge
+		summary.WarmupRequests += result.warmup
+		summary.ConnQueueTimeouts += result.connQueueTimeouts
+		summary.TooFast += result.tooFast
+		summary.TTFBTimeouts += result.ttfbTimeout
+		summary.TimedOut += result.timedOut
+		summary.Throttled += result.throttled
+		summary.AssertionFailed += result.assertionFailed
+		summary.BackoffTime += result.backoff.Seconds()
+		summary.SamplesDropped += result.samplesDropped
+		rtts = append(rtts, result.elapse...)
+		if result.reservoir > 0 {
+			summary.SamplesKept += int64(len(result.elapse))
+			summary.SamplesSeen += result.samplesSeen
+		}
+		result.mu.Lock()
+		for name, values := range result.capturedHeaders {
+			if summary.CapturedHeaders[name] == nil {
+				summary.CapturedHeaders[name] = make(map[string]int64)
+			}
+			for value, count := range values {
+				summary.CapturedHeaders[name][value] += count
+			}
+		}
+		for target, stats := range result.targets {
+			if summary.Targets[target] == nil {
+				summary.Targets[target] = &TargetStats{}
+			}
+			summary.Targets[target].add(stats)
+		}
+		for route, stats := range result.routes {
+			if summary.Routes[route] == nil {
+				summary.Routes[route] = &TargetStats{}
+			}
+			summary.Routes[route].add(stats)
+		}
+		for uri, stats := range result.urls {
+			if summary.URLs[uri] == nil {
+				summary.URLs[uri] = &TargetStats{}
+			}
+			summary.URLs[uri].add(stats)
+		}
+		for kind, count := range result.networkErrors {
+			summary.NetworkErrors[kind] += count
+		}
+		for phase, samples := range result.phases {
+			phaseSamples[phase] = append(phaseSamples[phase], samples...)
+		}
+		result.mu.Unlock()
+	}
+
+	if summary.ClientRequestsMin == -1 {
+		summary.ClientRequestsMin = 0
+	}
+
+	elapsed := int64(time.Since(startTime).Seconds())
+
+	if elapsed == 0 {
+		elapsed = 1
+	}
+
+	summary.Elapsed = elapsed
+	summary.SuccessRate = summary.Success / elapsed
+	summary.TotalRate = summary.Requests / elapsed
+	summary.RateBasis = rateBasis
+	summary.Rate = summary.SuccessRate
+	if rateBasis == "total" {
+		summary.Rate = summary.TotalRate
+	}
+	summary.Cancelled = atomic.LoadInt64(&drainCancelled)
+	summary.NoLatency = noLatency
+	if localPorts != nil {
+		portsMu.Lock()
+		summary.LocalPortsByIP = make(map[string]int64, len(localPorts))
+		for ip, ports := range localPorts {
+			summary.LocalPortsByIP[ip] = int64(len(ports))
+			summary.LocalPorts += int64(len(ports))
+		}
+		portsMu.Unlock()
+		summary.EphemeralPorts = ephemeralPortRange()
+	}
+	summary.ReadThroughput = atomic.LoadInt64(&readThroughput) / elapsed
+	summary.WriteThroughput = atomic.LoadInt64(&writeThroughput) / elapsed
+	summary.DecodedThroughput = atomic.LoadInt64(&decodedBytes) / elapsed
+
+	sort.Float64s(rtts)
+	setLatencies(summary, rtts)
+	if summary.SamplesDropped > 0 {
+		setStreamedLatencies(summary, results)
+	}
+	if summaryLatencies {
+		summary.Latencies = rtts
+	}
+
+	queueMu.Lock()
+	waits := append([]float64(nil), queueSamples...)
+	queueMu.Unlock()
+	sort.Float64s(waits)
+	summary.QueueWaitP50 = percentile(waits, 50)
+	summary.QueueWaitP90 = percentile(waits, 90)
+	summary.QueueWaitP99 = percentile(waits, 99)
+	summary.QueueWaitMax = percentile(waits, 100)
+
+	dnsMu.Lock()
+	lookups := append([]float64(nil), dnsSamples...)
+	dnsMu.Unlock()
+	sort.Float64s(lookups)
+	summary.DNSLookups = int64(len(lookups))
+	summary.DNSFailures = atomic.LoadInt64(&dnsFailures)
+	summary.DNSP50 = percentile(lookups, 50)
+	summary.DNSP90 = percentile(lookups, 90)
+	summary.DNSP99 = percentile(lookups, 99)
+
+	for phase, samples := range phaseSamples {
+		sort.Float64s(samples)
+		summary.Phases[phase] = &PhaseStats{
+			Samples: int64(len(samples)),
+			P50:     percentile(samples, 50),
+			P90:     percentile(samples, 90),
+			P99:     percentile(samples, 99),
+		}
+	}
+
+	summary.KeepAlivePruned = atomic.LoadInt64(&keepAlivePruned)
+	summary.MultipartBytes = atomic.LoadInt64(&multipartBytes)
+	if failureSamples != nil {
+		summary.ErrorSamples = failureSamples.list()
+	}
+	if runtimeStats {
+		summary.Runtime = readRuntimeStats()
+	}
+
+	if len(proxies) > 0 {
+		summary.Proxies = make(map[string]ProxyStats)
+		for _, p := range proxies {
+			summary.Proxies[p.address] = ProxyStats{
+				Connections:    atomic.LoadInt64(&p.stats.Connections),
+				Failed:         atomic.LoadInt64(&p.stats.Failed),
+				Requests:       atomic.LoadInt64(&p.stats.Requests),
+				RequestsFailed: atomic.LoadInt64(&p.stats.RequestsFailed),
+			}
+		}
+	}
+	summary.RampErrorsAt, summary.RampLatencyAt = rampThresholds()
+
+	if rpsTarget > 0 {
+		summary.TargetRate = rpsTarget
+		summary.TargetHeld = heldRate()
+		summary.TargetClients = atomic.LoadInt64(&activeClients)
+	}
+
+	connMu.Lock()
+	summary.ConnectionsMin = connMin
+	summary.ConnectionsMax = connMax
+	if connSamples > 0 {
+		summary.ConnectionsMean = float64(connSum) / float64(connSamples)
+	}
+	connMu.Unlock()
+
+	summary.IPv4Connections = atomic.LoadInt64(&ipv4Conns)
+	summary.IPv6Connections = atomic.LoadInt64(&ipv6Conns)
+
+	summary.ConnectionsOpened = atomic.LoadInt64(&dialedConns)
+	if reused := summary.Requests - summary.ConnectionsOpened; reused > 0 {
+		summary.ConnectionReuse = float64(reused) / float64(summary.Requests) * 100
+	}
+
+	summary.ContinueResponses = atomic.LoadInt64(&continueResponses)
+	if summary.ContinueResponses > 0 {
+		summary.ContinueDelay = time.Duration(atomic.LoadInt64(&continueDelay) / summary.ContinueResponses).Seconds()
+	}
+
+	return summary
+}
+
+// setLatencies sets the latency percentiles, mean and stddev of summary
+// from the sorted latencies rtts
+func setLatencies(summary *Summary, rtts []float64) {
+	summary.LatencyP50 = percentile(rtts, 50)
+	summary.LatencyP90 = percentile(rtts, 90)
+	summary.LatencyP99 = percentile(rtts, 99)
+	summary.LatencyMax = percentile(rtts, 100)
+
+	// the mean and stddev leave out the samples over -clip-percentile,
+	// the percentiles and max above don't
+	clipped := rtts
+	if clipPercentile > 0 {
+		limit := percentile(rtts, clipPercentile)
+		clipped = rtts[:sort.Search(len(rtts), func(i int) bool { return rtts[i] > limit })]
+		summary.ClipPercentile = clipPercentile
+		summary.ClippedSamples = int64(len(clipped))
+		summary.LatencySamples = int64(len(rtts))
+	}
+	summary.LatencyMean, summary.LatencyStddev = meanStddev(clipped)
+	summary.LatencyHistogram = newHistogram(rtts)
+}
+
+// mergeSummaries adds up the summaries of runs that went on side by side,
+// such as those of the -workers. Counters, rates and latency histograms add
+// up. The percentiles come from the merged histogram, so they are within
+// its 2% of the exact ones, the mean and stddev are combined from those of
+// the runs.
+func mergeSummaries(parts []*Summary) *Summary {
+	merged := &Summary{
+		RateBasis:         rateBasis,
+		ClientRequestsMin: -1,
+		NetworkErrors:     make(map[string]int64),
+		Targets:           make(map[string]*TargetStats),
+		Routes:            make(map[string]*TargetStats),
+		URLs:              make(map[string]*TargetStats),
+	}
+	counts := make(map[int]int64)
+	var samples, sum, squares float64
+	for _, part := range parts {
+		var n int64
+		for _, bucket := range part.LatencyHistogram {
+			counts[bucketIndex(bucket.Le)] += bucket.Count
+			n += bucket.Count
+		}
+		// the sums of the latencies and of their squares, as far as the
+		// mean and stddev of the part tell them
+		samples += float64(n)
+		sum += float64(n) * part.LatencyMean
+		squares += float64(n) * (part.LatencyStddev*part.LatencyStddev + part.LatencyMean*part.LatencyMean)
+		if part.LatencyMax > merged.LatencyMax {
+			merged.LatencyMax = part.LatencyMax
+		}
+		if part.ClipPercentile > 0 {
+			merged.ClipPercentile = part.ClipPercentile
+		}
+		merged.ClippedSamples += part.ClippedSamples
+		merged.LatencySamples += part.LatencySamples
+
+		merged.Requests += part.Requests
+		merged.Success += part.Success
+		merged.NetworkFailed += part.NetworkFailed
+		merged.BadFailed += part.BadFailed
+		merged.Redirects += part.Redirects
+		merged.AssertionFailed += part.AssertionFailed
+		merged.TimedOut += part.TimedOut
+		merged.TTFBTimeouts += part.TTFBTimeouts
+		merged.Throttled += part.Throttled
+		merged.TooFast += part.TooFast
+		merged.WarmupRequests += part.WarmupRequests
+		merged.SuccessRate += part.SuccessRate
+		merged.TotalRate += part.TotalRate
+		merged.ReadThroughput += part.ReadThroughput
+		merged.WriteThroughput += part.WriteThroughput
+		merged.DecodedThroughput += part.DecodedThroughput
+		merged.ConnectionsMin += part.ConnectionsMin
+		merged.ConnectionsMean += part.ConnectionsMean
+		merged.ConnectionsMax += part.ConnectionsMax
+		merged.ConnectionsOpened += part.ConnectionsOpened
+		if part.Elapsed > merged.Elapsed {
+			merged.Elapsed = part.Elapsed
+		}
+		if merged.ClientRequestsMin == -1 || part.ClientRequestsMin < merged.ClientRequestsMin {
+			merged.ClientRequestsMin = part.ClientRequestsMin
+		}
+		if part.ClientRequestsMax > merged.ClientRequestsMax {
+			merged.ClientRequestsMax = part.ClientRequestsMax
+		}
+		for kind, count := range part.NetworkErrors {
+			merged.NetworkErrors[kind] += count
+		}
+		for _, stats := range []struct{ to, from map[string]*TargetStats }{
+			{merged.Targets, part.Targets},
+			{merged.Routes, part.Routes},
+			{merged.URLs, part.URLs},
+		} {
+			for key, other := range stats.from {
+				if stats.to[key] == nil {
+					stats.to[key] = &TargetStats{}
+				}
+				stats.to[key].add(other)
+			}
+		}
+	}
+	if merged.ClientRequestsMin == -1 {
+		merged.ClientRequestsMin = 0
+	}
+
+	merged.Rate = merged.SuccessRate
+	if rateBasis == "total" {
+		merged.Rate = merged.TotalRate
+	}
+	if reused := merged.Requests - merged.ConnectionsOpened; reused > 0 && merged.Requests > 0 {
+		merged.ConnectionReuse = float64(reused) / float64(merged.Requests) * 100
+	}
+
+	indexes := make([]int, 0, len(counts))
+	for i := range counts {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		merged.LatencyHistogram = append(merged.LatencyHistogram, HistogramBucket{Le: histogramBound(i), Count: counts[i]})
+	}
+	// a bucket bound can be over the largest latency in the bucket
+	merged.LatencyP50 = math.Min(histogramPercentile(merged.LatencyHistogram, 50), merged.LatencyMax)
+	merged.LatencyP90 = math.Min(histogramPercentile(merged.LatencyHistogram, 90), merged.LatencyMax)
+	merged.LatencyP99 = math.Min(histogramPercentile(merged.LatencyHistogram, 99), merged.LatencyMax)
+	if samples > 0 {
+		merged.LatencyMean = sum / samples
+		merged.LatencyStddev = math.Sqrt(math.Max(squares/samples-merged.LatencyMean*merged.LatencyMean, 0))
+	}
+	return merged
+}
+
+// mergeSummaryFiles prints the merged summary of the JSON summaries at
+// paths, for the merge subcommand
+func mergeSummaryFiles(paths []string) error {
+	var parts []*Summary
+	for _, path := range paths {
+		part, err := loadSummary(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if part.Requests > 0 && len(part.LatencyHistogram) == 0 {
+			return fmt.Errorf("%s: no latency_histogram, the summary is from an older gobench", path)
+		}
+		parts = append(parts, part)
+	}
+
+	summary := mergeSummaries(parts)
+	if summaryOutPath != "" {
+		if err := writeSummaryFile(summaryOutPath, summary); err != nil {
+			return err
+		}
+	}
+	printFinalSummary(summary)
+	return nil
+}
+
+// writeDelays writes the request latencies in results to w, one per line,
+// or a random -sample-rate share of them. delay.txt keeps seconds unless a
+// unit is asked for explicitly.
+func writeDelays(w io.Writer, results map[int]*Result) {
+	delayUnit := timeUnits["s"]
+	if latencyUnit != "" {
+		delayUnit = timeUnits[latencyUnit]
+	}
+
+	for _, result := range results {
+		for _, rtt := range result.elapse {
+			if delaySampleRate < 1 && rand.Float64() >= delaySampleRate {
+				continue
+			}
+			fmt.Fprintf(w, "%f\n", rtt*delayUnit.scale)
+		}
+	}
+}
+
+func printResults(results map[int]*Result, startTime time.Time) {
+	f, err := os.Create("delay.txt")
+	if err != nil {
+		fmt.Println("open file failed")
+		panic(err)
+	}
+	defer f.Close()
+
+	writeDelays(f, results)
+
+	if windows != nil {
+		// the last window is cut short by the end of the run
+		windows.flush(true)
+	}
+
+	summary := summarize(results, startTime)
+
+	if summaryOutPath != "" {
+		if err := writeSummaryFile(summaryOutPath, summary); err != nil {
+			logger.Error("writing summary failed", "path", summaryOutPath, "err", err)
+		}
+	}
+	if influx != nil {
+		if err := influx.finish(summary); err != nil {
+			logger.Error("writing influx points failed", "err", err)
+		}
+	}
+
+	// the comparison would spoil a summary meant for a program
+	comparisonOut := os.Stdout
+	if reportFormat != "text" {
+		comparisonOut = os.Stderr
+	} else if perClient {
+		printClients(results, summaryTimeUnit())
+	}
+	printFinalSummary(summary)
+
+	if baselinePath != "" {
+		baseline, err := loadSummary(baselinePath)
+		if err != nil {
+			logger.Error("loading baseline failed", "path", baselinePath, "err", err)
+		} else {
+			printComparison(comparisonOut, baseline, summary)
+		}
+	}
+
+	checkNetworkErrors(summary)
+}
+
+// defaultSummaryTemplate is the layout of the main summary lines, the
+// optional lines of printSummary follow it. -output-template replaces both.
+const defaultSummaryTemplate = `
+Requests:                       {{printf "%10d" .Requests}} hits
+Successful requests:            {{printf "%10d" .Success}} hits
+Network failed:                 {{printf "%10d" .NetworkFailed}} hits
+Bad requests failed (!2xx):     {{printf "%10d" .BadFailed}} hits
+Successful requests rate:       {{printf "%10d" .SuccessRate}} hits/sec
+Total requests rate:            {{printf "%10d" .TotalRate}} hits/sec
+Read throughput:                {{printf "%10d" .ReadThroughput}} bytes/sec
+Write throughput:               {{printf "%10d" .WriteThroughput}} bytes/sec
+Test time:                      {{printf "%10d" .Elapsed}} sec
+{{- if .NoLatency}}
+Request latency:                   not timed (-no-latency)
+{{- else}}
+Average request latency:              {{latency .AverageLatency}}
+Request latency p50:                  {{latency .LatencyP50}}
+Request latency p90:                  {{latency .LatencyP90}}
+Request latency p99:                  {{latency .LatencyP99}}
+Request latency max:                  {{latency .LatencyMax}}
+{{- end}}
+`
+
+// the -output-template summary layout, nil for the default one
+var summaryTemplate *template.Template
+
+// summaryTimeUnit is the unit of the latencies in the printed summary
+func summaryTimeUnit() timeUnit {
+	if latencyUnit != "" {
+		return timeUnits[latencyUnit]
+	}
+	return timeUnits["ms"]
+}
+
+// summaryFuncs are the functions available to summary templates on top of
+// the Summary fields: latency formats seconds in the -latency-unit
+var summaryFuncs = template.FuncMap{
+	"latency": func(seconds float64) string {
+		return summaryTimeUnit().format(seconds)
+	},
+}
+
+var defaultTemplate = template.Must(template.New("summary").Funcs(summaryFuncs).Parse(defaultSummaryTemplate))
+
+func printSummary(summary *Summary) {
+	if summaryTemplate != nil {
+		if err := summaryTemplate.Execute(os.Stdout, summary); err != nil {
+			logger.Error("output template failed", "err", err)
+		}
+		return
+	}
+
+	summaryUnit := summaryTimeUnit()
+
+	if err := defaultTemplate.Execute(os.Stdout, summary); err != nil {
+		logger.Error("summary template failed", "err", err)
+	}
+
+	if summary.Redirects > 0 {
+		fmt.Printf("Redirects (3xx, not followed):  %10d hits\n", summary.Redirects)
+	}
+
+	if gzipResponses {
+		fmt.Printf("Decoded throughput:             %10d bytes/sec\n", summary.DecodedThroughput)
+	}
+
+	if clipPercentile > 0 {
+		label := fmt.Sprintf("p%g", clipPercentile)
+		fmt.Printf("%-38s%s\n", "Latency mean (clipped at "+label+"):", summaryUnit.format(summary.LatencyMean))
+		fmt.Printf("%-38s%s\n", "Latency stddev (clipped at "+label+"):", summaryUnit.format(summary.LatencyStddev))
+		fmt.Printf("%-38s%d of %d\n", "Latency samples (clipped at "+label+"):", summary.ClippedSamples, summary.LatencySamples)
+	}
+
+	if expectContinue {
+		fmt.Printf("100 Continue responses:         %10d hits\n", summary.ContinueResponses)
+		fmt.Printf("Average 100 Continue delay:           %s\n", summaryUnit.format(summary.ContinueDelay))
+	}
+
+	if multipartSize > 0 {
+		fmt.Printf("Multipart bytes streamed:       %10d bytes\n", summary.MultipartBytes)
+	}
+
+	if chunked {
+		fmt.Printf("Chunked requests accepted:      %10d hits\n", summary.Success)
+		fmt.Printf("Chunked requests rejected (411):%10d hits\n", summary.ChunkedRejected)
+	}
+
+	if totalRequests > 0 {
+		fmt.Printf("Requests per client (min/max):  %10s hits\n", fmt.Sprintf("%d/%d", summary.ClientRequestsMin, summary.ClientRequestsMax))
+	}
+
+	if reportReused || verbose {
+		fmt.Printf("Open connections (min/mean/max):%10s conns\n", fmt.Sprintf("%d/%.1f/%d", summary.ConnectionsMin, summary.ConnectionsMean, summary.ConnectionsMax))
+	}
+
+	if reportReused {
+		fmt.Printf("Connections opened:             %10d conns\n", summary.ConnectionsOpened)
+		fmt.Printf("Requests on reused connections: %10.2f %%\n", summary.ConnectionReuse)
+	}
+
+	if summary.DNSLookups > 0 || summary.DNSFailures > 0 {
+		fmt.Printf("DNS lookups:                    %10d hits\n", summary.DNSLookups)
+		fmt.Printf("DNS lookups failed:             %10d hits\n", summary.DNSFailures)
+		fmt.Printf("DNS lookup latency p50:               %s\n", summaryUnit.format(summary.DNSP50))
+		fmt.Printf("DNS lookup latency p90:               %s\n", summaryUnit.format(summary.DNSP90))
+		fmt.Printf("DNS lookup latency p99:               %s\n", summaryUnit.format(summary.DNSP99))
+	}
+
+	if connSummary {
+		// every local address has a range of ports of its own
+		ips := make([]string, 0, len(summary.LocalPortsByIP))
+		for ip := range summary.LocalPortsByIP {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+
+		if len(ips) > 1 {
+			fmt.Printf("Local ports used:               %10d ports\n", summary.LocalPorts)
+		}
+		for _, ip := range ips {
+			ports := fmt.Sprint(summary.LocalPortsByIP[ip])
+			if summary.EphemeralPorts > 0 {
+				ports = fmt.Sprintf("%d of %d", summary.LocalPortsByIP[ip], summary.EphemeralPorts)
+			}
+			label := "Local ports used:"
+			if len(ips) > 1 {
+				label = "Local ports used from " + ip + ":"
+			}
+			fmt.Printf("%-31s %10s ports\n", label, ports)
+		}
+	}
+
+	if ipVersion != "auto" || verbose {
+		fmt.Printf("IPv4 connections:               %10d conns\n", summary.IPv4Connections)
+		fmt.Printf("IPv6 connections:               %10d conns\n", summary.IPv6Connections)
+	}
+
+	if errorBackoff > 0 {
+		fmt.Printf("Backing off after errors:       %10.1f sec\n", summary.BackoffTime)
+	}
+
+	if rateEnd > 0 {
+		printRampThreshold(fmt.Sprintf("Errors over %.2f%% from:", rampMaxErrors), summary.RampErrorsAt)
+		if targetP99 > 0 {
+			printRampThreshold(fmt.Sprintf("p99 over %s from:", targetP99), summary.RampLatencyAt)
+		}
+	}
+
+	if rpsTarget > 0 {
+		fmt.Printf("Target rate:                    %10.0f req/sec\n", summary.TargetRate)
+		fmt.Printf("Rate held (last %d sec):         %10.0f req/sec\n", heldSeconds, summary.TargetHeld)
+		if summary.TargetHeld >= targetTolerance*summary.TargetRate {
+			fmt.Printf("Clients needed:                 %10d clients\n", summary.TargetClients)
+		} else if summary.TargetClients >= int64(clients) {
+			fmt.Printf("Target not reached with all %d clients (-c)\n", clients)
+		} else {
+			fmt.Printf("Target not reached yet, with %d clients\n", summary.TargetClients)
+		}
+	}
+
+	if schemaPath != "" || bodyRegex != "" || expectSHA256 != "" {
+		fmt.Printf("Assertion failures:             %10d hits\n", summary.AssertionFailed)
+	}
+
+	if tcpKeepAlive != 0 {
+		fmt.Printf("Connections pruned (keepalive): %10d conns\n", summary.KeepAlivePruned)
+	}
+
+	if maxMemory > 0 {
+		fmt.Printf("Latency samples dropped:        %10d hits\n", summary.SamplesDropped)
+		if summary.LatencyStreamed {
+			fmt.Println("Latency percentiles are from a histogram of every request (-max-memory), within 2%")
+		}
+	}
+
+	if maxSamples > 0 {
+		fmt.Printf("Latency samples kept:           %10d of %d\n", summary.SamplesKept, summary.SamplesSeen)
+		if summary.SamplesSeen > summary.SamplesKept {
+			fmt.Println("Latency percentiles are approximate, from the sample (-max-samples)")
+		}
+	}
+
+	if honorRetryAfter {
+		fmt.Printf("Throttled (429, waited):        %10d hits\n", summary.Throttled)
+	}
+
+	if gracefulDrain {
+		fmt.Printf("Cancelled (drain timeout):      %10d hits\n", summary.Cancelled)
+	}
+
+	if minLatency > 0 {
+		fmt.Printf("Faster than expected:           %10d hits\n", summary.TooFast)
+	}
+
+	if connStrategy != "shared" {
+		fmt.Printf("Connection strategy:            %10s\n", connStrategy)
+	}
+
+	if connsPerHost > 0 {
+		fmt.Printf("Connections per host:           %10d conns\n", connsPerHost)
+		fmt.Printf("Connection queue timeouts:      %10d hits\n", summary.ConnQueueTimeouts)
+		if backend != "net/http" {
+			fmt.Printf("Connection queue wait p50:            %s\n", summaryUnit.format(summary.QueueWaitP50))
+			fmt.Printf("Connection queue wait p90:            %s\n", summaryUnit.format(summary.QueueWaitP90))
+			fmt.Printf("Connection queue wait p99:            %s\n", summaryUnit.format(summary.QueueWaitP99))
+			fmt.Printf("Connection queue wait max:            %s\n", summaryUnit.format(summary.QueueWaitMax))
+		}
+	}
+
+	if requestTimeout > 0 {
+		fmt.Printf("Timed out requests:             %10d hits\n", summary.TimedOut)
+	}
+
+	if firstByteTimeout > 0 {
+		fmt.Printf("First byte timeouts:            %10d hits\n", summary.TTFBTimeouts)
+	}
+
+	if warmupRequests > 0 {
+		fmt.Printf("Warmup requests (excluded):     %10d hits\n", summary.WarmupRequests)
+	}
+
+	if maxResponseSize > 0 {
+		fmt.Printf("Responses over max size:        %10d hits\n", summary.BodyTooLarge)
+	}
+
+	if keepAliveReqs > 0 {
+		fmt.Printf("Forced reconnects:              %10d hits\n", summary.Reconnects)
+	}
+
+	if wsMode {
+		fmt.Printf("WebSocket connections failed:   %10d hits\n", summary.WSConnectFailed)
+		fmt.Printf("WebSocket messages failed:      %10d hits\n", summary.WSMessageFailed)
+	}
+
+	for _, name := range captureHeaders {
+		printCapturedHeader(name, summary.CapturedHeaders[name])
+	}
+
+	if len(summary.Targets) > 0 {
+		printTargets("Target", summary.Targets, summaryUnit)
+	}
+
+	if len(summary.Routes) > 0 {
+		printTargets("Route", summary.Routes, summaryUnit)
+	}
+
+	if errorsByURL {
+		printURLErrors(summary.URLs)
+	}
+
+	if len(summary.Phases) > 0 {
+		printPhases(summary.Phases, summaryUnit)
+	}
+
+	if summary.Runtime != nil {
+		printRuntimeStats(summary.Runtime, summaryUnit)
+	}
+
+	if len(summary.Proxies) > 0 {
+		printProxies(summary.Proxies)
+	}
+
+	if len(summary.ErrorSamples) > 0 {
+		printErrorSamples(summary.ErrorSamples)
+	}
+}
+
+// rateLabel names the rate of the summary, which -rate-basis picks
+func rateLabel() string {
+	if rateBasis == "total" {
+		return "Total requests rate:"
+	}
+	return "Successful requests rate:"
+}
+
+// printRampThreshold prints the offered rate at which a threshold of the
+// rate ramp was crossed
+func printRampThreshold(label string, rate float64) {
+	if rate == 0 {
+		fmt.Printf("%-32s%10s\n", label, "never")
+		return
+	}
+	fmt.Printf("%-32s%10.0f req/sec\n", label, rate)
+}
+
+// printTargets prints a table of stats by target, headed by title
+func printTargets(title string, targets map[string]*TargetStats, unit timeUnit) {
+	keys := make([]string, 0, len(targets))
+	for target := range targets {
+		keys = append(keys, target)
+	}
+	sort.Strings(keys)
+
+	fmt.Println()
+	if noLatency {
+		fmt.Printf("%-40s %10s %10s %10s\n", title, "Requests", "Success", "Failed")
+		for _, target := range keys {
+			stats := targets[target]
+			fmt.Printf("%-40s %10d %10d %10d\n", target, stats.Requests, stats.Success, stats.Failed)
+		}
+		return
+	}
+	fmt.Printf("%-40s %10s %10s %10s %12s\n", title, "Requests", "Success", "Failed", "Avg "+unit.label)
+	for _, target := range keys {
+		stats := targets[target]
+		var average float64
+		if stats.Requests > 0 {
+			average = stats.Latency / float64(stats.Requests) * unit.scale
+		}
+		fmt.Printf("%-40s %10d %10d %10d %12.*f\n", target, stats.Requests, stats.Success, stats.Failed, precision, average)
+	}
+}
+
+// printClients prints a table of the requests, success rate and mean
+// latency of each client, to spot a client that is starved or stuck
+func printClients(results map[int]*Result, unit timeUnit) {
+	ids := make([]int, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	if noLatency {
+		fmt.Printf("%-8s %10s %10s %10s\n", "Client", "Requests", "Success", "Success %")
+	} else {
+		fmt.Printf("%-8s %10s %10s %10s %12s\n", "Client", "Requests", "Success", "Success %", "Mean "+unit.label)
+	}
+	for _, id := range ids {
+		result := results[id]
+		var successRate float64
+		if result.requests > 0 {
+			successRate = float64(result.success) / float64(result.requests) * 100
+		}
+		if noLatency {
+			fmt.Printf("%-8d %10d %10d %9.1f%%\n", id, result.requests, result.success, successRate)
+			continue
+		}
+		mean, _ := meanStddev(result.elapse)
+		fmt.Printf("%-8d %10d %10d %9.1f%% %12.*f\n", id, result.requests, result.success, successRate, precision, mean*unit.scale)
+	}
+}
+
+// printURLErrors prints the URLs that had failures, most failures first,
+// with the kind of failure they had most
+func printURLErrors(urls map[string]*TargetStats) {
+	keys := make([]string, 0, len(urls))
+	for uri, stats := range urls {
+		if stats.Failed > 0 {
+			keys = append(keys, uri)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if urls[keys[i]].Failed != urls[keys[j]].Failed {
+			return urls[keys[i]].Failed > urls[keys[j]].Failed
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Println()
+	if len(keys) == 0 {
+		fmt.Println("No failures by URL")
+		return
+	}
+	fmt.Printf("%-40s %10s %10s  %s\n", "URL", "Requests", "Failed", "Top failure")
+	for _, uri := range keys {
+		stats := urls[uri]
+		var top string
+		for kind, count := range stats.Errors {
+			if top == "" || count > stats.Errors[top] || (count == stats.Errors[top] && kind < top) {
+				top = kind
+			}
+		}
+		fmt.Printf("%-40s %10d %10d  %s (%d)\n", uri, stats.Requests, stats.Failed, top, stats.Errors[top])
+	}
+}
+
+func printProxies(proxies map[string]ProxyStats) {
+	keys := make([]string, 0, len(proxies))
+	for address := range proxies {
+		keys = append(keys, address)
+	}
+	sort.Strings(keys)
+
+	fmt.Println()
+	fmt.Printf("%-40s %12s %10s %10s %10s\n", "Proxy", "Connections", "Failed", "Requests", "Failed")
+	for _, address := range keys {
+		stats := proxies[address]
+		fmt.Printf("%-40s %12d %10d %10d %10d\n", address, stats.Connections, stats.Failed, stats.Requests, stats.RequestsFailed)
+	}
+}
+
+// printErrorSamples prints the example request of each kind of failure
+func printErrorSamples(samples []ErrorSample) {
+	for _, sample := range samples {
+		fmt.Println()
+		fmt.Printf("=== %s (%d hits), first one:\n", sample.Failure, sample.Count)
+		fmt.Println(sample.Example)
+	}
+}
+
+func printRuntimeStats(stats *RuntimeStats, unit timeUnit) {
+	fmt.Println()
+	fmt.Printf("Goroutines:                     %10d\n", stats.Goroutines)
+	fmt.Printf("GOMAXPROCS (CPUs):              %10s\n", fmt.Sprintf("%d (%d)", stats.GOMAXPROCS, stats.NumCPU))
+	fmt.Printf("GC runs:                        %10d\n", stats.NumGC)
+	fmt.Printf("GC pause total:                       %s\n", unit.format(stats.GCPauseTotal))
+	fmt.Printf("GC pause max:                         %s\n", unit.format(stats.GCPauseMax))
+	fmt.Printf("GC CPU share:                   %9.2f%%\n", stats.GCCPUFraction*100)
+}
+
+func printPhases(phases map[string]*PhaseStats, unit timeUnit) {
+	fmt.Println()
+	fmt.Printf("%-12s %10s %12s %12s %12s\n", "Phase", "Samples", "p50 "+unit.label, "p90 "+unit.label, "p99 "+unit.label)
+	for _, phase := range phaseNames {
+		if stats := phases[phase]; stats != nil {
+			fmt.Printf("%-12s %10d %12.*f %12.*f %12.*f\n", phase, stats.Samples,
+				precision, stats.P50*unit.scale, precision, stats.P90*unit.scale, precision, stats.P99*unit.scale)
+		}
+	}
+}
+
+// summaryFormat prints the summary at the end of a run in one -format,
+// to stdout
+type summaryFormat interface {
+	print(summary *Summary)
+}
+
+// summaryFormats are the formats of -format by name, a new format only
+// needs an entry here
+var summaryFormats = map[string]summaryFormat{
+	"text":       textFormat{},
+	"json":       jsonFormat{},
+	"csv":        csvFormat{},
+	"prometheus": prometheusFormat{},
+}
+
+// checkFormat checks -format, and makes -json short for -format json.
+// Steps, repeats and the searches print tables of their runs as text, so
+// only the text format goes with them.
+func checkFormat() error {
+	if _, ok := summaryFormats[reportFormat]; !ok {
+		return fmt.Errorf("summary format must be one of: [text|json|csv|prometheus]")
+	}
+	if jsonOutput {
+		if reportFormat != "text" && reportFormat != "json" {
+			return fmt.Errorf("-json is -format json, it can't be combined with -format %s", reportFormat)
+		}
+		reportFormat = "json"
+	}
+	if reportFormat != "text" && (stepsSpec != "" || repeatCount > 1 || findMaxRate || autoConcurrency) {
+		return fmt.Errorf("-format %s prints a single summary, it can't be combined with -steps, -repeat, -find-max-throughput or -auto-concurrency", reportFormat)
+	}
+	return nil
+}
+
+// printFinalSummary prints summary in the -format of the run
+func printFinalSummary(summary *Summary) {
+	summaryFormats[reportFormat].print(summary)
+}
+
+// textFormat is the human readable summary, or the -output-template one
+type textFormat struct{}
+
+func (textFormat) print(summary *Summary) {
+	printSummary(summary)
+}
+
+// jsonFormat is the summary as an indented JSON document, the same as the
+// -summary-out file
+type jsonFormat struct{}
+
+func (jsonFormat) print(summary *Summary) {
+	out, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		logger.Error("encoding summary failed", "err", err)
+		return
+	}
+	fmt.Println(string(out))
+}
+
+// csvFormat is a header line of the JSON names of the summary values and
+// a line of the values, to append runs to a spreadsheet
+type csvFormat struct{}
+
+func (csvFormat) print(summary *Summary) {
+	names, values := summaryScalars(summary)
+	row := make([]string, len(values))
+	for i, value := range values {
+		row[i] = fmt.Sprint(value)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write(names)
+	w.Write(row)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logger.Error("writing summary failed", "err", err)
+	}
+}
+
+// prometheusFormat is the summary in the Prometheus text format, a gauge
+// per number named gobench_ and its JSON name, for a textfile collector or
+// a push gateway
+type prometheusFormat struct{}
+
+func (prometheusFormat) print(summary *Summary) {
+	names, values := summaryScalars(summary)
+	for i, value := range values {
+		switch v := value.(type) {
+		case string:
+			continue
+		case bool:
+			value = 0
+			if v {
+				value = 1
+			}
+		}
+		fmt.Printf("# TYPE gobench_%s gauge\ngobench_%s %v\n", names[i], names[i], value)
+	}
+}
+
+// summaryScalars returns the numbers, strings and booleans of summary with
+// their JSON names, in the order of the Summary fields. Maps and lists, such
+// as the stats per route, don't fit the flat formats and are left out.
+func summaryScalars(summary *Summary) ([]string, []interface{}) {
+	var names []string
+	var values []interface{}
+
+	v := reflect.ValueOf(summary).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		switch field := v.Field(i); field.Kind() {
+		case reflect.Int64, reflect.Float64, reflect.String, reflect.Bool:
+			names = append(names, name)
+			values = append(values, field.Interface())
+		}
+	}
+	return names, values
+}
+
+// writeSummaryFile writes the JSON summary to a temporary file next to path
+// and renames it into place, so readers never see a partial file
+func writeSummaryFile(path string, summary *Summary) error {
+	return writeJSONFile(path, summary)
+}
+
+// writeSummariesFile writes the summaries of the -steps or -repeat runs to
+// path as a JSON list, like writeSummaryFile
+func writeSummariesFile(path string, summaries []*Summary) error {
+	return writeJSONFile(path, summaries)
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".gobench-summary-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(out, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// TempFile creates the file readable by its owner only
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// influxRecorder batches the -influx points of the run in memory: a point
+// for every -influx-interval if asked for, and one for the summary. They
+// are written out all at once when the run ends or is interrupted, to the
+// file, the InfluxDB write URL or both.
+type influxRecorder struct {
+	latencyWindow
+
+	path string
+	url  string
+
+	mu      sync.Mutex
+	lines   []string
+	written bool
+}
+
+// the -influx recorder, nil without it
+var influx *influxRecorder
+
+// run adds an interval point every interval for the rest of the process
+func (r *influxRecorder) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		r.mu.Lock()
+		r.addInterval(now, r.take())
+		r.mu.Unlock()
+	}
+}
+
+// addInterval adds the point of the interval ending at now, of the sorted
+// latencies samples. r.mu must be held.
+func (r *influxRecorder) addInterval(now time.Time, samples []float64) {
+	r.lines = append(r.lines, fmt.Sprintf("gobench_interval%s requests=%di,latency_p50=%f,latency_p90=%f,latency_p99=%f,latency_max=%f %d",
+		influxTags(), len(samples), percentile(samples, 50), percentile(samples, 90), percentile(samples, 99), percentile(samples, 100), now.UnixNano()))
+}
+
+// finish adds the last, partial interval and the summary point, and writes
+// the points out. Only the first call writes, an interrupt may come after
+// the end of the run.
+func (r *influxRecorder) finish(summary *Summary) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.written {
+		return nil
+	}
+	r.written = true
+
+	now := time.Now()
+	if influxInterval > 0 {
+		if samples := r.take(); len(samples) > 0 {
+			r.addInterval(now, samples)
+		}
+	}
+	r.lines = append(r.lines, fmt.Sprintf("gobench%s requests=%di,success=%di,network_failed=%di,bad_failed=%di,"+
+		"success_rate=%di,total_rate=%di,read_throughput=%di,write_throughput=%di,elapsed=%di,"+
+		"latency_p50=%f,latency_p90=%f,latency_p99=%f,latency_max=%f,latency_mean=%f %d",
+		influxTags(), summary.Requests, summary.Success, summary.NetworkFailed, summary.BadFailed,
+		summary.SuccessRate, summary.TotalRate, summary.ReadThroughput, summary.WriteThroughput, summary.Elapsed,
+		summary.LatencyP50, summary.LatencyP90, summary.LatencyP99, summary.LatencyMax, summary.LatencyMean, now.UnixNano()))
+
+	batch := []byte(strings.Join(r.lines, "\n") + "\n")
+	if r.path != "" {
+		if err := ioutil.WriteFile(r.path, batch, 0644); err != nil {
+			return err
+		}
+	}
+	if r.url != "" {
+		return postInflux(r.url, batch)
+	}
+	return nil
+}
+
+// influxTags are the tags of the -influx points, with their leading comma:
+// the -label of the run if any
+func influxTags() string {
+	if runLabel == "" {
+		return ""
+	}
+	// commas, spaces and equal signs would end the tag value
+	return ",label=" + strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=").Replace(runLabel)
+}
+
+// postInflux sends a batch of line protocol points to an InfluxDB write
+// URL, which answers 204 No Content when it took them
+func postInflux(url string, batch []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token := os.Getenv("INFLUX_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx write failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+func loadSummary(path string) (*Summary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{}
+	if err := json.Unmarshal(data, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// regressionThreshold is how much worse (in percent) a metric may get before
+// the comparison flags it
+const regressionThreshold = 5.0
+
+// percentChange returns the change from before to after in percent
+func percentChange(before, after float64) float64 {
+	if before == 0 {
+		return 0
+	}
+	return (after - before) / before * 100
+}
+
+// printComparison prints the run next to a baseline run, marking the metrics
+// that got worse by more than regressionThreshold
+func printComparison(w io.Writer, baseline, current *Summary) {
+	mark := func(regressed bool) string {
+		if regressed {
+			return "  <- regression"
+		}
+		return ""
+	}
+
+	rateChange := percentChange(float64(baseline.Rate), float64(current.Rate))
+	p99Change := percentChange(baseline.LatencyP99, current.LatencyP99)
+	errorChange := (current.ErrorRate() - baseline.ErrorRate()) * 100
+
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Comparison with baseline:       %10s %10s %10s\n", "baseline", "current", "delta")
+	fmt.Fprintf(w, "%-32s%10d %10d %+9.2f%%%s\n", rateLabel(),
+		baseline.Rate, current.Rate, rateChange, mark(rateChange < -regressionThreshold))
+	unit := summaryTimeUnit()
+	fmt.Fprintf(w, "Request latency p99:            %10s %10s %+9.2f%%%s\n",
+		unit.format(baseline.LatencyP99), unit.format(current.LatencyP99), p99Change, mark(p99Change > regressionThreshold))
+	fmt.Fprintf(w, "Error rate:                     %9.2f%% %9.2f%% %+8.2fpp%s\n",
+		baseline.ErrorRate()*100, current.ErrorRate()*100, errorChange, mark(errorChange > 0))
+}
+
+// readDelays reads the latencies of a delay.txt file, one per line
+func readDelays(path string) ([]float64, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	delays := make([]float64, 0, len(lines))
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		delay, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		delays = append(delays, delay)
+	}
+	if len(delays) == 0 {
+		return nil, fmt.Errorf("no latencies")
+	}
+	return delays, nil
+}
+
+// mannWhitney runs a two-sided Mann-Whitney U test on two sorted samples,
+// with the normal approximation and ties corrected for. z is positive when
+// the values of a tend to be larger than the values of b.
+func mannWhitney(a, b []float64) (z, p float64) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	n := n1 + n2
+
+	// rank both samples together, ties get the mean of their ranks
+	var rankSumA, tieSum float64
+	below := 0.0
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		var v float64
+		switch {
+		case i == len(a):
+			v = b[j]
+		case j == len(b):
+			v = a[i]
+		default:
+			v = math.Min(a[i], b[j])
+		}
+
+		countA, countB := 0.0, 0.0
+		for ; i < len(a) && a[i] == v; i++ {
+			countA++
+		}
+		for ; j < len(b) && b[j] == v; j++ {
+			countB++
+		}
+
+		ties := countA + countB
+		rankSumA += countA * (below + (ties+1)/2)
+		tieSum += ties*ties*ties - ties
+		below += ties
+	}
+
+	u := rankSumA - n1*(n1+1)/2
+	variance := n1 * n2 / 12 * ((n + 1) - tieSum/(n*(n-1)))
+	if variance <= 0 {
+		// every value is the same
+		return 0, 1
+	}
+
+	z = (u - n1*n2/2) / math.Sqrt(variance)
+	return z, math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+// significance is the p-value under which compare calls a difference real
+const significance = 0.05
+
+// compareDelays is the compare subcommand: it prints the latency
+// percentiles of two delay.txt files side by side, and whether the new
+// latencies differ from the old ones beyond chance
+func compareDelays(oldPath, newPath string) error {
+	before, err := readDelays(oldPath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", oldPath, err)
+	}
+	after, err := readDelays(newPath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", newPath, err)
+	}
+	sort.Float64s(before)
+	sort.Float64s(after)
+
+	// as many decimals as delay.txt has, unless -precision says otherwise
+	digits := 6
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "precision" {
+			digits = precision
+		}
+	})
+
+	fmt.Printf("%-20s%12s %12s %10s\n", "", "old", "new", "delta")
+	fmt.Printf("%-20s%12d %12d\n", "Samples:", len(before), len(after))
+	row := func(label string, old, new float64) {
+		fmt.Printf("%-20s%12.*f %12.*f %+9.2f%%\n", label, digits, old, digits, new, percentChange(old, new))
+	}
+	oldMean, _ := meanStddev(before)
+	newMean, _ := meanStddev(after)
+	row("Mean:", oldMean, newMean)
+	for _, p := range []float64{50, 90, 99} {
+		row(fmt.Sprintf("p%g:", p), percentile(before, p), percentile(after, p))
+	}
+	row("Max:", before[len(before)-1], after[len(after)-1])
+
+	z, p := mannWhitney(before, after)
+	fmt.Println()
+	fmt.Printf("Mann-Whitney U test: z = %.2f, p = %.4f\n", z, p)
+	switch {
+	case p >= significance:
+		fmt.Printf("No significant difference (p >= %g)\n", significance)
+	case z > 0:
+		fmt.Printf("The new latencies are significantly lower (p < %g)\n", significance)
+	default:
+		fmt.Printf("The new latencies are significantly higher (p < %g)\n", significance)
+	}
+	return nil
+}
+
+func printCapturedHeader(name string, values map[string]int64) {
+	keys := make([]string, 0, len(values))
+	for value := range values {
+		keys = append(keys, value)
+	}
+	sort.Strings(keys)
+
+	fmt.Println()
+	fmt.Printf("Header %s:\n", name)
+	for _, value := range keys {
+		fmt.Printf("  %-30s%10d hits\n", value, values[value])
+	}
+}
+
+// replayEntry is one request of a -replay log
+type replayEntry struct {
+	method string
+	url    string
+}
+
+// replayLog hands out the requests of a -replay log in order, to whichever
+// client asks next
+type replayLog struct {
+	entries []replayEntry
+	loop    bool
+	next    int64
+}
+
+// readReplayLog parses a -replay log. Each line is "[method] path [status]":
+// the method defaults to GET, anything after the path (such as the status of
+// the original response) is ignored, and blank lines and lines starting with
+// # are skipped. Paths are relative to base unless they are full URLs.
+func readReplayLog(path string, base string) (*replayLog, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := &replayLog{}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		entry := replayEntry{method: "GET", url: fields[0]}
+		if len(fields) > 1 {
+			entry.method, entry.url = strings.ToUpper(fields[0]), fields[1]
+		}
+
+		if !strings.Contains(entry.url, "://") {
+			if base == "" {
+				return nil, fmt.Errorf("line %d: relative path %s needs a base URL (-u)", i+1, entry.url)
+			}
+			entry.url = strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(entry.url, "/")
+		}
+
+		replay.entries = append(replay.entries, entry)
+	}
+
+	if len(replay.entries) == 0 {
+		return nil, fmt.Errorf("no requests found")
+	}
+
+	return replay, nil
+}
+
+// nextEntry returns the next request to replay, or false when the log is
+// exhausted and not looping
+func (r *replayLog) nextEntry() (replayEntry, bool) {
+	i := atomic.AddInt64(&r.next, 1) - 1
+	if i >= int64(len(r.entries)) {
+		if !r.loop {
+			return replayEntry{}, false
+		}
+		i %= int64(len(r.entries))
+	}
+	return r.entries[i], true
+}
+
+// readWeights reads a -weights file of url<TAB>weight lines
+func readWeights(path string) (map[string]float64, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	weights := make(map[string]float64)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a URL and a weight", i+1)
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("line %d: invalid weight %s", i+1, fields[1])
+		}
+		weights[fields[0]] = weight
+	}
+	return weights, nil
+}
+
+// readURLs returns the URLs of the -f file at path, one per line, leaving
+// out blank lines and # comments
+func readURLs(path string) ([]string, error) {
+	lines, err := readLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, nil
+}
+
+// checkURLs fails a run with no urls to send its requests to, such as one
+// of a -f file with nothing but blank lines: -random would have nothing to
+// pick from and the clients would spin without sending a request. -replay
+// and -url-template bring URLs of their own.
+func checkURLs(urls []string) error {
+	if len(urls) == 0 && replayPath == "" && urlTemplateText == "" {
+		return fmt.Errorf("No URLs to benchmark in %s", urlsFilePath)
+	}
+	return nil
+}
+
+// cumulativeWeights returns the running totals of the -weights of urls, by
+// index, for pickURL. URLs left out of weights weigh 1. Weights that are
+// all zero leave nothing to pick.
+func cumulativeWeights(urls []string, weights map[string]float64) ([]float64, error) {
+	cumulative := make([]float64, 0, len(urls))
+	total := 0.0
+	for _, u := range urls {
+		weight, ok := weights[u]
+		if !ok {
+			weight = 1
+		}
+		total += weight
+		cumulative = append(cumulative, total)
+	}
+	if total <= 0 {
+		return nil, errors.New("The URL weights must not all be zero")
+	}
+	return cumulative, nil
+}
+
+// maxLineLength is the longest line readLines accepts, a URL longer than
+// this is almost certainly not one
+const maxLineLength = 1 << 20
+
+// readLines returns the lines of the file at path. A read error or a line
+// over maxLineLength fails the whole file rather than dropping lines.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return scanLines(file)
+}
+
+// scanLines returns the lines of r, as readLines does for a file
+func scanLines(r io.Reader) (lines []string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return nil, fmt.Errorf("line %d is longer than %d bytes", len(lines)+1, maxLineLength)
+		}
+		return nil, fmt.Errorf("after line %d: %s", len(lines), err)
+	}
+	return lines, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %s (expected 1.0, 1.1, 1.2 or 1.3)", version)
+	}
+	return v, nil
+}
+
+func newTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure, ServerName: sniName}
+
+	if minTLS != "" {
+		v, err := parseTLSVersion(minTLS)
+		if err != nil {
+			fmt.Println(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		tlsConfig.MinVersion = v
+	}
+
+	if maxTLS != "" {
+		v, err := parseTLSVersion(maxTLS)
+		if err != nil {
+			fmt.Println(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		tlsConfig.MaxVersion = v
+	}
+
+	if tlsConfig.MinVersion != 0 && tlsConfig.MaxVersion != 0 && tlsConfig.MinVersion > tlsConfig.MaxVersion {
+		fmt.Println("Minimum TLS version must not be greater than the maximum TLS version")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if verbose {
+		// called once per handshake, so every new connection reports its version
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			logger.Debug("negotiated TLS", "version", tls.VersionName(state.Version), "server", state.ServerName)
+			return nil
+		}
+	}
+
+	return tlsConfig
+}
+
+// loadConfigFile sets the flags of a -config file that were not given on
+// the command line. The file is a JSON object of flag name to value, with a
+// list of values for the repeatable flags.
+func loadConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range values {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %s", name)
+		}
+		if given[name] {
+			continue
+		}
+
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+		for _, v := range list {
+			if err := flag.Set(name, configValue(v)); err != nil {
+				return fmt.Errorf("flag %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue formats a JSON value of a -config file as a flag value
+func configValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// flagValues returns the flags that differ from their defaults, in the
+// format of -config. The worker flags are left out, a saved config must not
+// carry the -worker-token.
+func flagValues() map[string]interface{} {
+	values := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "save-config", "worker", "workers", "worker-token":
+			return
+		}
+		if f.Value.String() == f.DefValue {
+			return
+		}
+		switch v := f.Value.(type) {
+		case *intList:
+			values[f.Name] = []int(*v)
+		case *stringList:
+			values[f.Name] = []string(*v)
+		default:
+			values[f.Name] = f.Value.String()
+		}
+	})
+	return values
+}
+
+// saveConfigFile writes the flags that differ from their defaults to path,
+// in the format of -config
+func saveConfigFile(path string) error {
+	out, err := json.MarshalIndent(flagValues(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(out, '\n'), 0644)
+}
+
+func NewConfiguration() *Configuration {
+
+	if urlsFilePath == "" && url == "" && replayPath == "" && urlTemplateText == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	provided := 0
+	for _, v := range []int64{requests, totalRequests, period} {
+		if v != -1 {
+			provided++
+		}
+	}
+	if stepsSpec != "" {
+		provided++
+	}
+	if findMaxRate {
+		provided++
+	}
+	if autoConcurrency {
+		provided++
+	}
+
+	// a replay log that doesn't loop ends the run by itself, and -check
+	// sends a single request
+	if provided == 0 && (replayPath == "" || replayLoop) && !checkOnly {
+		fmt.Println("Requests, total requests, period, steps, find max throughput or auto concurrency must be provided")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if provided > 1 {
+		fmt.Println("Only one should be provided: [requests|total requests|period|steps|find max throughput|auto concurrency]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	configuration := &Configuration{
+		urls:            make([]string, 0),
+		method:          "GET",
+		postData:        nil,
+		keepAlive:       keepAlive,
+		requests:        int64((1 << 63) - 1),
+		authHeader:      authHeader,
+		acceptEnc:       acceptEnc,
+		randomize:       randomize,
+		uriSubstitution: uriSubstitution,
+		hostHeader:      hostHeader,
+		rate:            rate,
+		arrival:         arrival,
+		stopOnStatus:    make(map[int]bool),
+		captureHeaders:  captureHeaders,
+		chunked:         chunked,
+		expectContinue:  expectContinue,
+		keepAliveReqs:   keepAliveReqs,
+		discardBody:     discardBody,
+		warmupRequests:  warmupRequests,
+		cacheBust:       cacheBust,
+		contentLength:   contentLength,
+		honorRetryAfter: honorRetryAfter,
+		maxRetryAfter:   maxRetryAfter,
+		forceBody:       forceBody,
+		errorBackoff:    errorBackoff,
+		failFastConnect: failFastConnect,
+		warnSlow:        warnSlow,
+		minLatency:      minLatency,
+		thinkDist:       thinkDist,
+		thinkTime:       thinkTime,
+		thinkMin:        thinkMin,
+		thinkMax:        thinkMax,
+		thinkStddev:     thinkStddev,
+		contentType:     contentType}
+
+	if repeatCount < 1 {
+		fmt.Println("Repeat count must be at least 1")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if autoConcurrency && (targetP99 <= 0 || probeDuration <= 0) {
+		fmt.Println("Auto concurrency needs a target (-target-p99) and a probe duration")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if findMaxRate && (rate <= 0 || targetP99 <= 0 || probeDuration <= 0) {
+		fmt.Println("Finding the max throughput needs an upper bound (-rate), a target (-target-p99) and a probe duration")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if repeatCount > 1 && stepsSpec != "" {
+		fmt.Println("Only one should be provided: [repeat|steps]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if workersList != "" {
+		if repeatCount > 1 || stepsSpec != "" || findMaxRate || autoConcurrency || checkOnly {
+			fmt.Println("Distributed runs (-workers) can't be combined with -repeat, -steps, -find-max-throughput, -auto-concurrency or -check")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if clients < len(strings.Split(workersList, ",")) {
+			fmt.Println("Distributed runs (-workers) need at least one client (-c) per worker")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if workerToken == "" {
+			fmt.Println("Distributed runs (-workers) need the -worker-token of the workers")
+			flag.Usage()
+			os.Exit(1)
+		}
+		for name := range flagValues() {
+			if !workerFlags[name] && !workerJobFlags[name] {
+				fmt.Printf("-%s can't be used with -workers, the workers only run jobs of network flags\n", name)
+				flag.Usage()
+				os.Exit(1)
+			}
+		}
+	}
+
+	// repeated runs time each run themselves, as do the workers of -workers
+	if period != -1 && repeatCount == 1 && workersList == "" {
+		configuration.period = period
+
+		timeout := make(chan bool, 1)
+		go func() {
+			<-time.After(time.Duration(period) * time.Second)
+			timeout <- true
+		}()
+
+		go func() {
+			<-timeout
+			if runtime.GOOS == "windows" {
+				if gracefulDrain {
+					drain(nil)
+				}
+				printResults(results, startTime)
+				os.Exit(0)
+			}
+			pid := os.Getpid()
+			proc, _ := os.FindProcess(pid)
+			err := proc.Signal(os.Interrupt)
+			if err != nil {
+				logger.Error("stopping the run", "err", err)
+				return
+			}
+		}()
+	}
+
+	if err := checkFormat(); err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if _, ok := timeUnits[latencyUnit]; latencyUnit != "" && !ok {
+		fmt.Println("Latency unit must be one of: [s|ms|us|ns]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := logLevel.UnmarshalText([]byte(logLevelName)); err != nil {
+		fmt.Println("Log level must be one of: [error|warn|info|debug]")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if verbose && logLevel.Level() > slog.LevelDebug {
+		logLevel.Set(slog.LevelDebug)
+	}
+
+	if precision < 0 {
+		fmt.Println("Precision must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if clipPercentile < 0 || clipPercentile > 100 {
+		fmt.Println("Clip percentile must be between 0 and 100")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if delaySampleRate <= 0 || delaySampleRate > 1 {
+		fmt.Println("Sample rate must be over 0 and at most 1")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if rateBasis != "success" && rateBasis != "total" {
+		fmt.Println("Rate basis must be one of: [success|total]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if arrival != "uniform" && arrival != "poisson" {
+		fmt.Println("Arrival must be one of: [uniform|poisson]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if rate < 0 {
+		fmt.Println("Rate must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if requestTimeout < 0 {
+		fmt.Println("Timeout (-timeout) must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	configuration.requestTimeout = requestTimeout
+
+	if clientRate < 0 {
+		fmt.Println("Client rate (-client-rate) must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	configuration.clientRate = clientRate
+
+	if rateStart > 0 || rateEnd > 0 {
+		if rateStart <= 0 || rateEnd <= 0 || period == -1 || rate > 0 {
+			fmt.Println("A rate ramp needs both -rate-start and -rate-end, a period (-t) and no fixed -rate")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.rateStart = rateStart
+		configuration.rateEnd = rateEnd
+		configuration.rampDuration = time.Duration(period) * time.Second
+	}
+
+	if rpsTarget < 0 {
+		fmt.Println("Target rate (-rps-target) must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if rpsTarget > 0 {
+		if period == -1 || rate > 0 || rateStart > 0 || stepsSpec != "" || repeatCount > 1 || findMaxRate || autoConcurrency {
+			fmt.Println("A target rate (-rps-target) needs a period (-t) and no -rate, rate ramp, -steps, -repeat, -find-max-throughput or -auto-concurrency")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.rpsTarget = rpsTarget
+	}
+
+	switch thinkDist {
+	case "constant", "exponential":
+	case "uniform":
+		if thinkMin < 0 || thinkMax < thinkMin {
+			fmt.Println("Uniform think times need 0 <= -think-min <= -think-max")
+			flag.Usage()
+			os.Exit(1)
+		}
+	case "normal":
+		if thinkStddev < 0 {
+			fmt.Println("Think time standard deviation must not be negative")
+			flag.Usage()
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("Think time distribution must be one of: [constant|uniform|exponential|normal]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// the tables by client, target, route and URL and -statsd leave their
+	// latencies out instead, and the ramp has only its error threshold
+	// without -target-p99
+	if noLatency && (warnSlow > 0 || minLatency > 0 || windowCSVPath != "" || influxInterval > 0 || targetP99 > 0 ||
+		findMaxRate || autoConcurrency || rpsTarget > 0 || phases || clipPercentile > 0) {
+		fmt.Println("Requests aren't timed with -no-latency, it can't be combined with -warn-slow, -min-expected-latency, -window-csv, -influx-interval, -target-p99, -find-max-throughput, -auto-concurrency, -rps-target, -phases or -clip-percentile")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if gracefulDrain && drainTimeout <= 0 {
+		fmt.Println("Drain timeout (-drain-timeout) must be positive")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if thinkTime < 0 {
+		fmt.Println("Think time must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	for _, status := range stopOnStatus {
+		configuration.stopOnStatus[status] = true
+	}
+
+	if statsdAddr != "" {
+		if statsdSample <= 0 || statsdSample > 1 {
+			fmt.Println("StatsD sample rate (-statsd-sample) must be above 0 and at most 1")
+			flag.Usage()
+			os.Exit(1)
+		}
+		client, err := newStatsdClient(statsdAddr, statsdSample)
+		if err != nil {
+			fmt.Printf("Invalid StatsD address: %s\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.statsd = client
+	}
+
+	if influxPath != "" || influxURL != "" {
+		if influxURL != "" {
+			u, err := neturl.Parse(influxURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				fmt.Println("InfluxDB write URL (-influx-url) must be an http or https URL")
+				flag.Usage()
+				os.Exit(1)
+			}
+		}
+		if influxInterval < 0 {
+			fmt.Println("Influx interval (-influx-interval) must not be negative")
+			flag.Usage()
+			os.Exit(1)
+		}
+		influx = &influxRecorder{path: influxPath, url: influxURL}
+	} else if influxInterval > 0 || runLabel != "" {
+		fmt.Println("Influx intervals (-influx-interval) and labels (-label) need -influx or -influx-url")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if windowCSVPath != "" {
+		if windowLength <= 0 {
+			fmt.Println("Window length must be positive")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		f, err := os.Create(windowCSVPath)
+		if err != nil {
+			log.Fatalf("Error in os.Create for file path: %s Error: %s", windowCSVPath, err)
+		}
+		windows = &windowRecorder{file: f}
+		fmt.Fprintln(f, "elapsed,requests,p50,p95,p99,max")
+	}
+
+	if maxBodyPrint < 0 {
+		fmt.Println("Maximum body print size must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if logFailuresPath != "" {
+		f, err := os.Create(logFailuresPath)
+		if err != nil {
+			log.Fatalf("Error in os.Create for file path: %s Error: %s", logFailuresPath, err)
+		}
+		configuration.failureLog = &failureLog{file: f, max: logFailuresMax}
+	}
+
+	if stepsSpec != "" {
+		steps, err := parseSteps(stepsSpec)
+		if err != nil {
+			fmt.Println(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.steps = steps
+	}
+
+	var proxySpecs []string
+	if proxyList != "" {
+		proxySpecs = strings.Split(proxyList, ",")
+	}
+	if proxyFile != "" {
+		lines, err := readLines(proxyFile)
+		if err != nil {
+			log.Fatalf("Error reading proxy file: %s Error: %s", proxyFile, err)
+		}
+		proxySpecs = append(proxySpecs, lines...)
+	}
+	for _, spec := range proxySpecs {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		p, err := parseProxy(spec)
+		if err != nil {
+			fmt.Println(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		// fail now rather than with every connection that picks it
+		conn, err := net.DialTimeout("tcp", p.address, 5*time.Second)
+		if err != nil {
+			log.Fatalf("Error connecting to proxy: %s Error: %s", p.address, err)
+		}
+		conn.Close()
+
+		proxies = append(proxies, p)
+	}
+
+	if ipVersion != "4" && ipVersion != "6" && ipVersion != "auto" {
+		fmt.Println("IP version must be one of: [4|6|auto]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	for _, addr := range strings.Split(localAddrs, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			fmt.Printf("Invalid local address (-local-addr): %s\n", addr)
+			flag.Usage()
+			os.Exit(1)
+		}
+		// an address the host doesn't have fails every connect the same
+		// way as running out of ports would, better say so now
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+		if err != nil {
+			log.Fatalf("Error binding to local address: %s Error: %s", addr, err)
+		}
+		ln.Close()
+		localIPs = append(localIPs, ip)
+	}
+
+	if connSummary {
+		localPorts = make(map[string]map[string]struct{})
+	}
+
+	if hostsList != "" {
+		for _, host := range strings.Split(hostsList, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				configuration.hosts = append(configuration.hosts, host)
+			}
+		}
+
+		if hostSelect != "round-robin" && hostSelect != "random" {
+			fmt.Println("Host selection must be one of: [round-robin|random]")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.randomHosts = hostSelect == "random"
+	}
+
+	if maxDuration > 0 {
+		// a safety net for request count runs against a hung backend:
+		// clients stop after their current request, which the read and
+		// write timeouts bound
+		go func() {
+			select {
+			case <-time.After(maxDuration):
+				logger.Info("maximum duration reached, stopping the run", "max_duration", maxDuration)
+				abortRun()
+			case <-rootCtx.Done():
+			}
+		}()
+	}
+
+	if maxSamples < 0 {
+		fmt.Println("Maximum samples must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	configuration.maxSamples = maxSamples
+
+	if maxMemory < 0 {
+		fmt.Println("Maximum memory must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if outputTemplate != "" {
+		tmpl, err := template.New("output").Funcs(summaryFuncs).ParseFiles(outputTemplate)
+		if err != nil {
+			log.Fatalf("Error parsing output template: %s Error: %s", outputTemplate, err)
+		}
+		summaryTemplate = tmpl.Lookup(filepath.Base(outputTemplate))
+	}
+
+	if maxMemory > 0 {
+		go watchMemory(uint64(maxMemory) << 20)
+	}
+
+	if requests != -1 {
+		configuration.requests = requests
+	}
+
+	if totalRequests != -1 {
+		configuration.totalRequests = totalRequests
+	}
+
+	if urlsFilePath != "" {
+		fileURLs, err := readURLs(urlsFilePath)
+
+		if err != nil {
+			log.Fatalf("Error in ioutil.ReadFile for file: %s Error: %s", urlsFilePath, err)
+		}
+
+		configuration.urls = fileURLs
+	}
+
+	if url != "" {
+		configuration.urls = append(configuration.urls, url)
+	}
+
+	if err := checkURLs(configuration.urls); err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if weightsPath != "" {
+		weights, err := readWeights(weightsPath)
+		if err != nil {
+			log.Fatalf("Error reading weights file: %s Error: %s", weightsPath, err)
+		}
+
+		configuration.urlWeights, err = cumulativeWeights(configuration.urls, weights)
+		if err != nil {
+			fmt.Println(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.randomize = true
+	}
+
+	if replayPath != "" {
+		replay, err := readReplayLog(replayPath, url)
+		if err != nil {
+			log.Fatalf("Error reading replay log: %s Error: %s", replayPath, err)
+		}
+		replay.loop = replayLoop
+		configuration.replay = replay
+	}
+
+	if postDataFilePath != "" {
+		configuration.method = "POST"
+
+		data, err := ioutil.ReadFile(postDataFilePath)
+
+		if err != nil {
+			log.Fatalf("Error in ioutil.ReadFile for file path: %s Error:%s", postDataFilePath, err)
+		}
+
+		if bodyRepeat > 1 {
+			// the body is built once and held in memory for the whole run
+			if int64(len(data))*int64(bodyRepeat) > maxRepeatedBody {
+				fmt.Printf("Repeated body (-body-repeat) would be over %d bytes\n", int64(maxRepeatedBody))
+				flag.Usage()
+				os.Exit(1)
+			}
+			data = bytes.Repeat(data, bodyRepeat)
+			logger.Info("repeated POST data", "path", postDataFilePath, "times", bodyRepeat, "bytes", len(data))
+		}
+
+		configuration.postData = data
+	}
+	if bodyRepeat < 1 || (bodyRepeat > 1 && postDataFilePath == "") {
+		fmt.Println("Body repeat count (-body-repeat) must be positive, and repeats the -d body")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if gzipDataPath != "" {
+		if postDataFilePath != "" || bodyTemplatePath != "" {
+			fmt.Println("Gzipped POST data (-dgz) can't be combined with -d or -body-template")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.method = "POST"
+
+		data, err := ioutil.ReadFile(gzipDataPath)
+		if err != nil {
+			log.Fatalf("Error in ioutil.ReadFile for file path: %s Error:%s", gzipDataPath, err)
+		}
+		// the gzip magic number, the body is sent without a second look
+		if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+			log.Fatalf("Error in gzipped POST data file: %s Error: not gzipped", gzipDataPath)
+		}
+
+		configuration.postData = data
+		configuration.contentEnc = "gzip"
+		logger.Info("sending gzipped POST data", "path", gzipDataPath, "bytes", len(data))
+	}
+
+	if multipartSize != 0 {
+		if multipartSize < 0 {
+			fmt.Println("Multipart upload size (-multipart-stream) must be positive")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if postDataFilePath != "" || gzipDataPath != "" || bodyTemplatePath != "" || chunked || contentLength != -1 {
+			fmt.Println("Multipart uploads (-multipart-stream) can't be combined with -d, -dgz, -body-template, -chunked or -content-length")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if backend == "net/http" {
+			fmt.Println("Multipart uploads (-multipart-stream) need the fasthttp backend")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.method = "POST"
+		configuration.multipartSize = multipartSize
+	}
+
+	if urlTemplateText != "" {
+		text := urlTemplateText
+		if !strings.Contains(text, "://") {
+			if url == "" {
+				fmt.Println("A relative URL template needs a base URL (-u)")
+				flag.Usage()
+				os.Exit(1)
+			}
+			text = strings.TrimSuffix(url, "/") + "/" + strings.TrimPrefix(text, "/")
+		}
+
+		// .Vars are empty until the first -extract, not "<no value>"
+		tmpl, err := template.New("url").Funcs(templateFuncs(nil)).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			fmt.Printf("Invalid URL template: %s\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.urlTemplate = tmpl
+	}
+
+	if bodyTemplatePath != "" {
+		configuration.method = "POST"
+
+		tmpl, err := template.New("body").Funcs(templateFuncs(nil)).Option("missingkey=zero").ParseFiles(bodyTemplatePath)
+		if err != nil {
+			log.Fatalf("Error parsing body template: %s Error: %s", bodyTemplatePath, err)
+		}
+
+		configuration.bodyTemplate = tmpl.Lookup(filepath.Base(bodyTemplatePath))
+	}
+
+	if getBody {
+		if len(configuration.postData) == 0 && bodyTemplatePath == "" {
+			fmt.Println("GET bodies (-get-body) need POST data (-d, -dgz or -body-template)")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.method = "GET"
+		configuration.getBody = true
+	}
+
+	if schemaPath != "" {
+		schema, err := loadSchema(schemaPath)
+		if err != nil {
+			log.Fatalf("Error loading JSON schema: %s Error: %s", schemaPath, err)
+		}
+		configuration.schema = schema
+	}
+
+	if normalizeURLs != "" {
+		pattern := autoRoutePattern
+		if normalizeURLs != "auto" {
+			var err error
+			if pattern, err = regexp.Compile(normalizeURLs); err != nil {
+				fmt.Printf("Invalid URL normalization regex: %s\n", err)
+				flag.Usage()
+				os.Exit(1)
+			}
+		}
+		configuration.routePattern = pattern
+	}
+	configuration.errorsByURL = errorsByURL
+
+	if bodyRegex != "" {
+		pattern, err := regexp.Compile(bodyRegex)
+		if err != nil {
+			fmt.Printf("Invalid body regex: %s\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.bodyRegex = pattern
+	}
+
+	if expectSHA256 != "" {
+		sum, err := hex.DecodeString(expectSHA256)
+		if err != nil || len(sum) != sha256.Size {
+			fmt.Println("Expected SHA-256 (-expect-sha256) must be 64 hex digits")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.bodySHA256 = sum
+	}
+
+	if keepErrSamples < 0 {
+		fmt.Println("Error samples to keep must not be negative")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if keepErrSamples > 0 {
+		failureSamples = &errorSamples{max: keepErrSamples, byKind: make(map[string]*ErrorSample)}
+	}
+
+	for _, value := range randHeaderFlags {
+		h, err := parseRandomHeader(value)
+		if err != nil {
+			fmt.Println(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.randomHeaders = append(configuration.randomHeaders, h)
+	}
+	if idempotencyHdr != "" {
+		// a -random-header with a UUID for its value
+		h, err := parseRandomHeader(idempotencyHdr + ": <UUID>")
+		if err != nil || strings.Contains(idempotencyHdr, ":") {
+			fmt.Printf("Invalid idempotency header name: %q\n", idempotencyHdr)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.randomHeaders = append(configuration.randomHeaders, h)
+	}
+
+	for _, value := range extractFlags {
+		e, err := parseExtraction(value)
+		if err != nil {
+			fmt.Println(err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.extracts = append(configuration.extracts, e)
+	}
+	if len(configuration.extracts) > 0 && configuration.urlTemplate == nil && configuration.bodyTemplate == nil {
+		fmt.Println("Extracted values (-extract) are only used by -url-template and -body-template")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if discardBody && configuration.checksBody() {
+		fmt.Println("Response bodies can't be checked (-schema, -expect-body-regex, -expect-sha256) or extracted from (-extract) when they are discarded (-discard-body)")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if gzipResponses {
+		if acceptEnc != "" && acceptEnc != "gzip" {
+			fmt.Println("Gzip responses (-gzip) set the Accept-Encoding header, they can't be combined with another -accept")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if discardBody {
+			fmt.Println("Gzip responses (-gzip) can't be decoded when they are discarded (-discard-body)")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.acceptEnc = "gzip"
+		configuration.gzip = true
+	}
+
+	if contentLength != -1 && (contentLength < 0 || chunked) {
+		fmt.Println("Content length must not be negative, nor combined with chunked requests")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if chunked && len(configuration.postData) == 0 && bodyTemplatePath == "" {
+		fmt.Println("Chunked requests need POST data (-d, -dgz or -body-template)")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	configuration.myClient.ReadTimeout = time.Duration(readTimeout) * time.Millisecond
+	configuration.myClient.WriteTimeout = time.Duration(writeTimeout) * time.Millisecond
+	configuration.myClient.MaxResponseBodySize = maxResponseSize
+	configuration.myClient.ReadBufferSize = readBufferSize
+	configuration.myClient.StreamResponseBody = discardBody
+	configuration.myClient.MaxConnsPerHost = clients
+	for _, step := range configuration.steps {
+		if step.clients > configuration.myClient.MaxConnsPerHost {
+			configuration.myClient.MaxConnsPerHost = step.clients
+		}
+	}
+	switch {
+	case connStrategy == "shared":
+	case connStrategy == "per-client":
+		if connsPerHost > 0 {
+			fmt.Println("Connections per host (-conns-per-host) can't be limited with -conn-strategy per-client, use pool:N")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.clientConns = newClientConns(&configuration.myClient)
+	case strings.HasPrefix(connStrategy, "pool:"):
+		size, err := strconv.Atoi(strings.TrimPrefix(connStrategy, "pool:"))
+		if err != nil || size <= 0 {
+			fmt.Println("Connection pool size (-conn-strategy pool:N) must be a positive integer")
+			flag.Usage()
+			os.Exit(1)
+		}
+		if connsPerHost > 0 && connsPerHost != size {
+			fmt.Println("Connections per host (-conns-per-host) and -conn-strategy pool:N disagree, give only one")
+			flag.Usage()
+			os.Exit(1)
+		}
+		connsPerHost = size
+	default:
+		fmt.Println("Connection strategy (-conn-strategy) must be one of: [shared|per-client|pool:N]")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if connsPerHost > 0 {
+		// clients beyond the limit queue for a free connection instead of
+		// failing straight away, for as long as a request may take
+		configuration.myClient.MaxConnsPerHost = connsPerHost
+		configuration.myClient.MaxConnWaitTimeout = time.Duration(readTimeout+writeTimeout) * time.Millisecond
+		configuration.connSlots = newSlotDoer(&configuration.myClient, connsPerHost, configuration.myClient.MaxConnWaitTimeout)
+	}
+	configuration.myClient.Name = userAgent
+	configuration.myClient.TLSConfig = newTLSConfig()
+
+	configuration.myClient.Dial = MyDialer()
+
+	perHost := configuration.myClient.MaxConnsPerHost
+	if configuration.clientConns != nil {
+		// and per client
+		perHost = 1
+	}
+	strategyLog := logger.Debug
+	if connStrategy != "shared" {
+		strategyLog = logger.Info
+	}
+	strategyLog("connection strategy", "strategy", connStrategy, "conns_per_host", perHost, "queueing", connsPerHost > 0)
+
+	if backend != "fasthttp" && backend != "net/http" {
+		fmt.Println("Backend must be one of: [fasthttp|net/http]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if phases && backend != "net/http" {
+		// fasthttp has no hooks into the DNS lookup, connect and TLS handshake
+		fmt.Println("Phases (-phases) need the net/http backend (-backend net/http)")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if firstByteTimeout > 0 && backend != "net/http" {
+		// fasthttp reads the response in one go, with no hook at the first byte
+		fmt.Println("First byte timeout (-first-byte-timeout) needs the net/http backend (-backend net/http)")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if backend == "net/http" {
+		// these act on the fasthttp requests, responses or connections,
+		// net/http would silently ignore them
+		var unsupported []string
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"-stop-on-status", len(stopOnStatus) > 0},
+			{"-capture-header", len(captureHeaders) > 0},
+			{"-log-failures", logFailuresPath != ""},
+			{"-honor-retry-after", honorRetryAfter},
+			{"-keepalive-requests", keepAliveReqs > 0},
+			{"-chunked", chunked},
+			{"-content-length", contentLength != -1},
+			{"-expect-continue", expectContinue},
+			{"-max-response-size", maxResponseSize > 0},
+			{"-read-buffer", readBufferSize > 0},
+			{"-discard-body", discardBody},
+		} {
+			if option.set {
+				unsupported = append(unsupported, option.name)
+			}
+		}
+		if len(unsupported) > 0 {
+			fmt.Printf("The net/http backend (-backend net/http) doesn't support %s, they need the fasthttp backend\n", strings.Join(unsupported, ", "))
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		configuration.netHTTP = true
+		configuration.phases = phases
+		configuration.ttfbTimeout = firstByteTimeout
+		configuration.httpClient = newNetHTTPClient(configuration.myClient.MaxConnsPerHost)
+	}
+
+	if checkOnly && (wsMode || grpcMode) {
+		fmt.Println("Checks (-check) print HTTP requests, not -ws or -grpc ones")
+		flag.Usage()
+		os.Exit(1)
+	}
+	configuration.check = checkOnly
+
+	if wsMode && grpcMode {
+		fmt.Println("Only one should be provided: [ws|grpc]")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if wsMode {
+		if wsCount <= 0 {
+			fmt.Println("WebSocket message count must be positive")
+			flag.Usage()
+			os.Exit(1)
+		}
+		configuration.websocket = true
+	}
+
+	if grpcMode {
+		if grpcMethod == "" {
+			fmt.Println("A gRPC method (-grpc-method) must be provided with -grpc")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		configuration.grpc = true
+		configuration.grpcClient = newGRPCClient()
+		for i, u := range configuration.urls {
+			configuration.urls[i] = strings.TrimSuffix(u, "/") + "/" + strings.TrimPrefix(grpcMethod, "/")
+		}
+	}
+
+	return configuration
+}
+
+// connections opened over each IP version
+var ipv4Conns int64
+var ipv6Conns int64
+
+// connections opened by MyDialer, directly or through a proxy; the
+// requests beyond them went over reused keep-alive connections
+var dialedConns int64
+
+// the distinct local ports of the connections dialed, by local IP, with
+// -connections-summary, guarded by portsMu
+var portsMu sync.Mutex
+var localPorts map[string]map[string]struct{}
+
+// recordLocalPort adds the local address of conn to localPorts
+func recordLocalPort(conn net.Conn) {
+	if localPorts == nil {
+		return
+	}
+	ip, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return
+	}
+
+	portsMu.Lock()
+	if localPorts[ip] == nil {
+		localPorts[ip] = make(map[string]struct{})
+	}
+	localPorts[ip][port] = struct{}{}
+	portsMu.Unlock()
+}
+
+// ephemeralPortRange is the number of ephemeral ports of each local
+// address, as Linux tells it, 0 where it can't be read
+func ephemeralPortRange() int64 {
+	data, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0
+	}
+	low, err1 := strconv.ParseInt(fields[0], 10, 64)
+	high, err2 := strconv.ParseInt(fields[1], 10, 64)
+	if err1 != nil || err2 != nil || high < low {
+		return 0
+	}
+	return high - low + 1
+}
+
+// the -local-addr addresses, taken in turn by the connections
+var localIPs []net.IP
+var localCursor uint64
+
+// DNS lookups made by MyDialer: their latencies in seconds (guarded by
+// dnsMu) and how many failed
+var dnsMu sync.Mutex
+var dnsSamples []float64
+var dnsFailures int64
+
+// resolve looks host up on its own rather than as part of net.Dial, so the
+// time it takes can be reported apart from connecting. ipNetwork is ip, ip4
+// or ip6.
+func resolve(ctx context.Context, ipNetwork string, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if dnsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIP(ctx, ipNetwork, host)
+	if err != nil {
+		atomic.AddInt64(&dnsFailures, 1)
+		return nil, err
+	}
+
+	if keepSamples() {
+		dnsMu.Lock()
+		dnsSamples = append(dnsSamples, time.Since(start).Seconds())
+		dnsMu.Unlock()
+	}
+
+	return ips, nil
+}
+
+// MyDialContext is MyDialer with a context, which also carries the
+// httptrace hooks of -phases down to the DNS lookup and the connect
+func MyDialContext() func(ctx context.Context, address string) (net.Conn, error) {
+	network, ipNetwork := "tcp", "ip"
+	switch ipVersion {
+	case "4":
+		network, ipNetwork = "tcp4", "ip4"
+	case "6":
+		network, ipNetwork = "tcp6", "ip6"
+	}
+
+	// zero keeps the Go default probe period, negative turns probes off
+	dialer := net.Dialer{KeepAlive: tcpKeepAlive}
+
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		dialer := dialer
+		if len(localIPs) > 0 {
+			ip := localIPs[(atomic.AddUint64(&localCursor, 1)-1)%uint64(len(localIPs))]
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+
+		if len(proxies) > 0 {
+			conn, p, err := dialProxy(ctx, &dialer, network, address)
+			if err != nil {
+				return nil, err
+			}
+			recordLocalPort(conn)
+			atomic.AddInt64(&openConns, 1)
+			atomic.AddInt64(&dialedConns, 1)
+
+			myConn := &MyConn{Conn: conn}
+			// WebSocket messages and multiplexed gRPC streams don't take
+			// turns with their responses on the wire
+			if !wsMode && !grpcMode {
+				myConn.proxy = p
+			}
+			return myConn, nil
+		}
+
+		ips, err := resolve(ctx, ipNetwork, host)
+		if err != nil {
+			return nil, err
+		}
+
+		// like net.Dial, try the addresses in turn until one connects
+		var conn net.Conn
+		for _, ip := range ips {
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+			atomic.AddInt64(&ipv6Conns, 1)
+		} else {
+			atomic.AddInt64(&ipv4Conns, 1)
+		}
+
+		recordLocalPort(conn)
+		myConn := &MyConn{Conn: conn}
+		atomic.AddInt64(&openConns, 1)
+		atomic.AddInt64(&dialedConns, 1)
+
+		return myConn, nil
+	}
+}
+
+// proxy is one HTTP proxy of -proxy, with the counts of the connections
+// and requests tunneled through it (updated atomically)
+type proxy struct {
+	address string
+	auth    string // Proxy-Authorization value, if any
+
+	stats ProxyStats
+}
+
+// ProxyStats are the counts of the connections and requests through one
+// proxy
+type ProxyStats struct {
+	Connections    int64 `json:"connections"`
+	Failed         int64 `json:"failed"`
+	Requests       int64 `json:"requests"`
+	RequestsFailed int64 `json:"requests_failed"`
+}
+
+// the -proxy pool, and the next proxy to use from it
+var proxies []*proxy
+var proxyCursor uint64
+
+// parseProxy parses a [http://][user:pass@]host:port proxy
+func parseProxy(spec string) (*proxy, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "http://" + spec
+	}
+	u, err := neturl.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy %s is not an http://host:port proxy", spec)
+	}
+
+	p := &proxy{address: u.Host}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		p.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+	return p, nil
+}
+
+// dialProxy opens a tunnel to address through the next proxy of the pool,
+// with an HTTP CONNECT request, and returns it with the proxy. The proxies
+// take turns per connection.
+func dialProxy(ctx context.Context, dialer *net.Dialer, network string, address string) (net.Conn, *proxy, error) {
+	p := proxies[(atomic.AddUint64(&proxyCursor, 1)-1)%uint64(len(proxies))]
+
+	conn, err := dialer.DialContext(ctx, network, p.address)
+	if err != nil {
+		atomic.AddInt64(&p.stats.Failed, 1)
+		return nil, nil, err
+	}
+
+	connect := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if p.auth != "" {
+		connect += "Proxy-Authorization: " + p.auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, connect+"\r\n"); err != nil {
+		conn.Close()
+		atomic.AddInt64(&p.stats.Failed, 1)
+		return nil, nil, err
+	}
+
+	// the target says nothing before the client does, so the reader can't
+	// have buffered anything past the response to the CONNECT
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		atomic.AddInt64(&p.stats.Failed, 1)
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		atomic.AddInt64(&p.stats.Failed, 1)
+		return nil, nil, fmt.Errorf("proxy %s: CONNECT %s: %s", p.address, address, resp.Status)
+	}
+
+	atomic.AddInt64(&p.stats.Connections, 1)
+	return conn, p, nil
+}
+
+func MyDialer() func(address string) (conn net.Conn, err error) {
+	dial := MyDialContext()
+
+	return func(address string) (net.Conn, error) {
+		return dial(context.Background(), address)
+	}
+}
+
+// newGRPCClient returns an HTTP/2 client for gRPC calls: h2c for http://
+// URLs and h2 over TLS for https:// ones, dialing through MyDialer
+func newGRPCClient() *http.Client {
+	dial := MyDialContext()
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return dial(ctx, address)
+		},
+		TLSClientConfig: newTLSConfig(),
+		MaxConnsPerHost: clients,
+		Protocols:       protocols,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(readTimeout+writeTimeout) * time.Millisecond,
+	}
+}
+
+// grpcCall issues one unary gRPC call with the POST data as the request
+// message and returns the grpc-status of the response
+func grpcCall(configuration *Configuration, target string) (int, error) {
+	// length-prefixed message: compressed flag, big endian length, message
+	frame := make([]byte, 5+len(configuration.postData))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(configuration.postData)))
+	copy(frame[5:], configuration.postData)
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(frame))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if len(configuration.hostHeader) > 0 {
+		req.Host = configuration.hostHeader
+	}
+
+	resp, err := configuration.grpcClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// the status is only in the trailers once the body has been read
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, err
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		// trailers-only responses carry it in the headers
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status == "" {
+		return 0, fmt.Errorf("no grpc-status in response (HTTP status %d)", resp.StatusCode)
+	}
+
+	return strconv.Atoi(status)
+}
+
+// grpcRequest runs one gRPC call and records it in result: status OK is a
+// success, any other status a bad request
+func grpcRequest(configuration *Configuration, result *Result, target string, rand *rand.Rand) {
+	start := startTiming()
+	status, err := grpcCall(configuration, target)
+	result.requests++
+	failFast(configuration, err)
+	warnIfSlow(configuration, target, status, elapsedSince(start))
+	checkTooFast(configuration, result, target, status, err, elapsedSince(start))
+	if configuration.statsd != nil {
+		configuration.statsd.send(configuration, status, elapsedSince(start), err)
+	}
+
+	if err != nil {
+		logger.Warn("network error", "err", err)
+		countNetworkError(result, err)
+		return
+	}
+
+	// the arguments allocate even when debug messages are off
+	if logger.Enabled(runCtx, slog.LevelDebug) {
+		logger.Debug("response", "grpc_status", status, "latency", elapsedSince(start))
+	}
+
+	if status != 0 {
+		result.badFailed++
+	} else {
+		result.success++
+	}
+	recordLatency(result, elapsedSince(start), rand)
+}
+
+// newNetHTTPClient returns the HTTP/1.1 client of -backend net/http,
+// dialing through MyDialer and keeping up to maxConns connections per host
+func newNetHTTPClient(maxConns int) *http.Client {
+	dial := MyDialContext()
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return dial(ctx, address)
+		},
+		TLSClientConfig:     newTLSConfig(),
+		MaxConnsPerHost:     maxConns,
+		MaxIdleConnsPerHost: maxConns,
+		DisableKeepAlives:   !keepAlive,
+		// like fasthttp, only ask for compression with -accept
+		DisableCompression: true,
+	}
+
+	timeout := time.Duration(readTimeout+writeTimeout) * time.Millisecond
+	if requestTimeout > 0 {
+		// netHTTPCall bounds every request with -timeout instead
+		timeout = 0
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// like fasthttp, don't follow redirects
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// request phases timed by -phases, in the order they happen
+var phaseNames = []string{"dns", "connect", "tls", "ttfb", "transfer"}
+
+// phaseTrace collects when the phases of one net/http request start and
+// end. The transport may dial on another goroutine, hence mu.
+type phaseTrace struct {
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+func (t *phaseTrace) mark(at *time.Time) {
+	t.mu.Lock()
+	*at = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *phaseTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart: func(string, string) {
+			// the connect phase covers every address tried
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone:          func(string, string, error) { t.mark(&t.connectDone) },
+		TLSHandshakeStart:    func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	}
+}
+
+// record adds the phases the request went through to result, end being
+// when its body was read. Requests on a reused connection have no dns,
+// connect or tls phase.
+func (t *phaseTrace) record(result *Result, end time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	if result.phases == nil {
+		result.phases = make(map[string][]float64)
+	}
+	add := func(phase string, start, done time.Time) {
+		if !start.IsZero() && !done.IsZero() {
+			result.phases[phase] = append(result.phases[phase], done.Sub(start).Seconds())
+		}
+	}
+
+	add("dns", t.dnsStart, t.dnsDone)
+	add("connect", t.connectStart, t.connectDone)
+	add("tls", t.tlsStart, t.tlsDone)
+	add("ttfb", t.wroteRequest, t.firstByte)
+	add("transfer", t.firstByte, end)
+}
+
+// errFirstByteTimeout fails requests of -first-byte-timeout
+var errFirstByteTimeout = errors.New("no response byte within the first byte timeout")
+
+// errRequestTimeout fails requests that took longer than -timeout
+var errRequestTimeout = errors.New("request timed out")
+
+// netHTTPCall sends one request with the net/http client and reads the
+// whole response, tracing its phases into trace unless it is nil. It
+// returns the status code and the response body when configuration checks
+// it.
+func netHTTPCall(configuration *Configuration, method string, uri string, body []byte, headers []header, clientID int, trace *phaseTrace) (int, []byte, error) {
+	var reqBody io.Reader
+	if len(body) > 0 {
+		reqBody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, uri, reqBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	if configuration.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), configuration.requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	// the request and the reading of its body share one deadline
+	timedOut := func(err error) error {
+		if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+			return errRequestTimeout
+		}
+		return err
+	}
+	if trace != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	}
+
+	// -first-byte-timeout starts once the request is written and stops at
+	// the first byte of the response, the body may take longer
+	var ttfbExpired int32
+	if configuration.ttfbTimeout > 0 {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+
+		var timerMu sync.Mutex
+		var timer *time.Timer
+		stop := func() {
+			timerMu.Lock()
+			if timer != nil {
+				timer.Stop()
+			}
+			timerMu.Unlock()
+		}
+		defer stop()
+
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				timerMu.Lock()
+				timer = time.AfterFunc(configuration.ttfbTimeout, func() {
+					atomic.StoreInt32(&ttfbExpired, 1)
+					cancel()
+				})
+				timerMu.Unlock()
+			},
+			GotFirstResponseByte: stop,
+		})
+		req = req.WithContext(ctx)
+	}
+
+	if len(configuration.hostHeader) > 0 {
+		req.Host = configuration.hostHeader
+	}
+	if len(configuration.acceptEnc) > 0 {
+		req.Header.Set("Accept-Encoding", configuration.acceptEnc)
+	}
+	if len(configuration.contentEnc) > 0 && len(body) > 0 {
+		req.Header.Set("Content-Encoding", configuration.contentEnc)
+	}
+	if len(configuration.contentType) > 0 {
+		req.Header.Set("Content-Type", configuration.contentType)
+	}
+	if len(userAgent) > 0 {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	for _, h := range headers {
+		req.Header.Set(h.name, h.value)
+	}
+
+	if configuration.check {
+		dump, _ := httputil.DumpRequestOut(req, true)
+		os.Stdout.Write(dump)
+		fmt.Println("\n---")
+	}
+
+	resp, err := configuration.netHTTPClient(clientID).Do(req)
+	if err != nil {
+		if configuration.check {
+			fmt.Printf("Request failed: %s\n", err)
+		}
+		if atomic.LoadInt32(&ttfbExpired) == 1 {
+			return 0, nil, errFirstByteTimeout
+		}
+		return 0, nil, timedOut(err)
+	}
+	defer resp.Body.Close()
+
+	if configuration.check {
+		dump, _ := httputil.DumpResponse(resp, true)
+		os.Stdout.Write(dump)
+		fmt.Println()
+	}
+
+	// the transport doesn't decode the gzip bodies it didn't ask for itself
+	var respReader io.Reader = resp.Body
+	if configuration.gzip && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		decoder, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("decoding the gzip body: %s", err)
+		}
+		respReader = decoder
+	}
+
+	// the body is only kept when it is going to be checked
+	if configuration.checksBody() {
+		respBody, err := io.ReadAll(respReader)
+		if err != nil {
+			err = timedOut(err)
+		}
+		if configuration.gzip {
+			atomic.AddInt64(&decodedBytes, int64(len(respBody)))
+		}
+		return resp.StatusCode, respBody, err
+	}
+
+	n, err := io.Copy(io.Discard, respReader)
+	if configuration.gzip {
+		atomic.AddInt64(&decodedBytes, n)
+	}
+	if err != nil {
+		return 0, nil, timedOut(err)
+	}
+
+	return resp.StatusCode, nil, nil
+}
+
+// gunzipBody replaces the body of a gzip encoded -gzip response with the
+// decoded one, for the checks, extracts and logs to see the actual content
+func gunzipBody(resp *fasthttp.Response) error {
+	if !bytes.EqualFold(resp.Header.Peek("Content-Encoding"), []byte("gzip")) {
+		atomic.AddInt64(&decodedBytes, int64(len(resp.Body())))
+		return nil
+	}
+
+	body, err := resp.BodyGunzip()
+	if err != nil {
+		return fmt.Errorf("decoding the gzip body: %s", err)
+	}
+	resp.SetBody(body)
+	atomic.AddInt64(&decodedBytes, int64(len(body)))
+	return nil
+}
+
+// netHTTPRequest runs one request of -backend net/http and records it in
+// result, the same way as the fasthttp requests
+func netHTTPRequest(configuration *Configuration, result *Result, method string, uri string, body []byte, headers []header, target string, clientID int, vars map[string]string, rand *rand.Rand) {
+	var trace *phaseTrace
+	if configuration.phases {
+		trace = &phaseTrace{}
+	}
+
+	start := startTiming()
+	statusCode, respBody, err := netHTTPCall(configuration, method, uri, body, headers, clientID, trace)
+	result.requests++
+	failFast(configuration, err)
+	warnIfSlow(configuration, uri, statusCode, elapsedSince(start))
+	checkTooFast(configuration, result, uri, statusCode, err, elapsedSince(start))
+	if configuration.statsd != nil {
+		configuration.statsd.send(configuration, statusCode, elapsedSince(start), err)
+	}
+
+	if target != "" {
+		recordTarget(result, target, err == nil && statusCode == http.StatusOK, elapsedSince(start))
+	}
+	if configuration.routePattern != nil {
+		recordRoute(result, normalizeURL(configuration, uri), err == nil && statusCode == http.StatusOK, elapsedSince(start))
+	}
+	if configuration.errorsByURL {
+		recordURL(result, urlKey(configuration, uri), failureKind(statusCode, err), elapsedSince(start))
+	}
+	if configuration.rampDuration > 0 {
+		recordRamp(configuration, err == nil && statusCode == http.StatusOK, elapsedSince(start))
+	}
+
+	if err != nil {
+		logger.Warn("network error", "err", err)
+		countNetworkError(result, err)
+		sampleNetHTTPFailure("network error: "+networkErrorKind(err), err.Error(), method, uri, nil)
+		if errors.Is(err, errFirstByteTimeout) {
+			result.ttfbTimeout++
+		}
+		if errors.Is(err, errRequestTimeout) {
+			result.timedOut++
+		}
+		return
+	}
+
+	if trace != nil && keepSamples() {
+		trace.record(result, time.Now())
+	}
+
+	if logger.Enabled(runCtx, slog.LevelDebug) {
+		logger.Debug("response", "status", statusCode, "latency", elapsedSince(start))
+	}
+
+	if isRedirect(statusCode) {
+		result.redirects++
+	} else if statusCode != http.StatusOK {
+		result.badFailed++
+		if failureSamples != nil {
+			kind := fmt.Sprintf("status code %d", statusCode)
+			sampleNetHTTPFailure(kind, kind, method, uri, respBody)
+		}
+	} else if err := checkBody(configuration, respBody); err != nil {
+		logger.Debug("assertion failed", "err", err)
+		result.assertionFailed++
+		sampleNetHTTPFailure("assertion failed", err.Error(), method, uri, respBody)
+	} else {
+		result.success++
+		if vars != nil {
+			extractVars(configuration, respBody, vars)
+		}
+	}
+	recordLatency(result, elapsedSince(start), rand)
+}
+
+// websocketGUID is appended to the key to compute Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsConn is a minimal client side WebSocket connection, enough to send
+// text messages and read back the echo
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// wsDial opens a WebSocket connection to target through MyDialer
+func wsDial(configuration *Configuration, target string) (*wsConn, error) {
+	u, err := neturl.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	conn, err := MyDialer()(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "wss" {
+		tlsConfig := configuration.myClient.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Duration(readTimeout) * time.Millisecond))
+
+	host := u.Host
+	if len(configuration.hostHeader) > 0 {
+		host = configuration.hostHeader
+	}
+
+	// the key and the masks must not be predictable, RFC 6455 section 10.3
+	nonce := make([]byte, 16)
+	if _, err := cryptorand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	handshake := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed with status %d", resp.StatusCode)
+	}
+
+	return &wsConn{conn: conn, reader: reader}, nil
+}
+
+// writeFrame writes a single masked frame, as clients must
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+
+	mask := make([]byte, 4)
+	if _, err := cryptorand.Read(mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// maxWSMessage bounds a WebSocket message read back, whatever the frame
+// lengths claim, so that a broken or hostile server can't make the client
+// allocate gigabytes
+const maxWSMessage = 16 << 20
+
+// readMessage reads the next data message, answering pings on the way
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7f)
+
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+		if length > maxWSMessage || uint64(len(message))+length > maxWSMessage {
+			return nil, fmt.Errorf("websocket message over %d bytes", maxWSMessage)
+		}
+
+		var mask []byte
+		if masked {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(c.reader, mask); err != nil {
+				return nil, err
+			}
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			if masked {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch opcode {
+		case 0x8:
+			return nil, fmt.Errorf("websocket closed by server")
+		case 0x9:
+			if err := c.writeFrame(0xA, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case 0xA:
+			continue
+		}
+
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// wsClient is the client loop of -ws: it opens a connection, sends -ws-count
+// messages and waits for each echo, then reconnects, until the run is over.
+// Each message counts as a request, a failed connect counts as a failed one.
+func wsClient(configuration *Configuration, result *Result, rand *rand.Rand, pacer *pacer) {
+	payload := []byte(wsMessage)
+
+	// the URLs are taken in turn, or picked at random with -random
+	next := 0
+
+	for result.requests < configuration.requests {
+		var target string
+		if configuration.randomize {
+			target = pickURL(configuration, rand)
+		} else {
+			target = configuration.urls[next%len(configuration.urls)]
+			next++
+		}
+
+		// warmup messages are extra, they don't use up the -n budget
+		warming := result.warmup < configuration.warmupRequests
+		if runCtx.Err() != nil || (!warming && !claimRequest(configuration)) {
+			return
+		}
+
+		conn, err := wsDial(configuration, target)
+		if warming {
+			if err != nil {
+				result.warmup++
+				continue
+			}
+		} else {
+			failFast(configuration, err)
+			if err != nil {
+				logger.Warn("network error", "err", err)
+				result.requests++
+				countNetworkError(result, err)
+				result.wsConnectFailed++
+				continue
+			}
+		}
+
+		for i := 0; i < wsCount && result.requests < configuration.requests; i++ {
+			// the first message of the connection already holds a claim
+			if i > 0 {
+				// -snapshot-on-signal reads the result while the client waits
+				result.recordMu.Unlock()
+				pause(wsInterval)
+				pacer.wait(rand)
+				result.recordMu.Lock()
+				warming = result.warmup < configuration.warmupRequests
+				if runCtx.Err() != nil || (!warming && !claimRequest(configuration)) {
+					break
+				}
+			}
+
+			start := time.Now()
+			conn.conn.SetDeadline(start.Add(time.Duration(readTimeout) * time.Millisecond))
+
+			err := conn.writeFrame(0x1, payload)
+			var reply []byte
+			if err == nil {
+				reply, err = conn.readMessage()
+			}
+			if warming {
+				result.warmup++
+				if err != nil {
+					break
+				}
+				continue
+			}
+			result.requests++
+
+			if err != nil {
+				logger.Warn("network error", "err", err)
+				countNetworkError(result, err)
+				result.wsMessageFailed++
+				break
+			}
+
+			logger.Debug("echo", "bytes", len(reply), "latency", time.Since(start))
+
+			if !bytes.Equal(reply, payload) {
+				result.badFailed++
+			} else {
+				result.success++
+			}
+			recordLatency(result, time.Since(start), rand)
+		}
+
+		conn.Close()
+	}
+}
+
+// templateSeq numbers the requests that execute a template, across clients
+var templateSeq int64
+
+// templateData is what request templates are executed with
+type templateData struct {
+	Seq      int64
+	ClientID string
+	Now      time.Time
+
+	// Vars are the -extract values of the last response of the client
+	Vars map[string]string
+
+	rand *rand.Rand
+}
+
+// UUID returns a new random UUID every time it is used in a template
+func (d *templateData) UUID() string {
+	return newUUID(d.rand)
+}
+
+// newUUID returns a random (version 4) UUID. With -seed it is drawn from
+// the client's rand, so the same seed gives the same UUIDs.
+func newUUID(rand *rand.Rand) string {
+	if seed == 0 {
+		return uuid.New()
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// templateFuncs returns the functions available in request templates,
+// drawing from rand. Templates are parsed with a nil rand and every client
+// binds its own with clientTemplate, so that -seed repeats them too.
+func templateFuncs(rand *rand.Rand) template.FuncMap {
+	return template.FuncMap{
+		// rand returns a random int in [0, n)
+		"rand": func(n int) int {
+			return rand.Intn(n)
+		},
+		// randInt returns a random int in [min, max]
+		"randInt": func(min, max int) int {
+			return min + rand.Intn(max-min+1)
+		},
+	}
+}
+
+// clientTemplate returns the copy of tmpl a client executes, its template
+// functions drawing from the client's rand
+func clientTemplate(tmpl *template.Template, rand *rand.Rand) *template.Template {
+	if tmpl == nil {
+		return nil
+	}
+	clone, err := tmpl.Clone()
+	if err != nil {
+		log.Fatalf("Error copying template: %s Error: %s", tmpl.Name(), err)
+	}
+	return clone.Funcs(templateFuncs(rand))
+}
+
+func newTemplateData(id string, rand *rand.Rand, vars map[string]string) *templateData {
+	return &templateData{
+		Seq:      atomic.AddInt64(&templateSeq, 1),
+		ClientID: id,
+		Now:      time.Now(),
+		Vars:     vars,
+		rand:     rand,
+	}
+}
+
+// extraction is one -extract: the value at path in a JSON response becomes
+// .Vars.name in the next templates of the client
+type extraction struct {
+	path []string
+	name string
+}
+
+// parseExtraction parses an -extract value such as "data.items.0.id as ID",
+// the path may start with "$."
+func parseExtraction(value string) (extraction, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 || fields[1] != "as" {
+		return extraction{}, fmt.Errorf("extract %q is not \"json.path as NAME\"", value)
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(fields[0], "$"), ".")
+	if path == "" {
+		return extraction{}, fmt.Errorf("extract %q has an empty path", value)
+	}
+	return extraction{path: strings.Split(path, "."), name: fields[2]}, nil
+}
+
+// lookupJSON returns the value at path in a decoded JSON document, array
+// elements being addressed by their index
+func lookupJSON(value interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// extractVars sets vars from the -extract paths of a response body. A path
+// missing from the body leaves its previous value, strings are kept as they
+// are and other values in their JSON form.
+func extractVars(configuration *Configuration, body []byte, vars map[string]string) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		logger.Debug("extract failed", "err", err)
+		return
+	}
+
+	for _, e := range configuration.extracts {
+		value, ok := lookupJSON(doc, e.path)
+		if !ok {
+			logger.Debug("extract path not found", "path", strings.Join(e.path, "."))
+			continue
+		}
+		if str, ok := value.(string); ok {
+			vars[e.name] = str
+			continue
+		}
+		raw, _ := json.Marshal(value)
+		vars[e.name] = string(raw)
+	}
+}
+
+// hostCursor is the round-robin position in -hosts, shared by all clients
+var hostCursor uint64
+
+// pickURL picks one of the URLs at random, by -weights when given
+func pickURL(configuration *Configuration, rand *rand.Rand) string {
+	weights := configuration.urlWeights
+	if weights == nil {
+		return configuration.urls[rand.Intn(len(configuration.urls))]
+	}
+
+	x := rand.Float64() * weights[len(weights)-1]
+	return configuration.urls[sort.Search(len(weights), func(i int) bool { return weights[i] > x })]
+}
+
+// pickHost returns the -hosts entry for the next request
+func pickHost(configuration *Configuration, rand *rand.Rand) string {
+	if configuration.randomHosts {
+		return configuration.hosts[rand.Intn(len(configuration.hosts))]
+	}
+	i := atomic.AddUint64(&hostCursor, 1) - 1
+	return configuration.hosts[i%uint64(len(configuration.hosts))]
+}
+
+// replaceHost swaps the host[:port] of uri for host
+func replaceHost(uri string, host string) string {
+	start := strings.Index(uri, "://")
+	if start < 0 {
+		return uri
+	}
+	start += len("://")
+
+	end := strings.IndexAny(uri[start:], "/?#")
+	if end < 0 {
+		return uri[:start] + host
+	}
+	return uri[:start] + host + uri[start+end:]
+}
+
+// autoRoutePattern matches the path segments -normalize-urls auto takes
+// for IDs: numbers, UUIDs and long hex strings
+var autoRoutePattern = regexp.MustCompile(`(^|/)([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})(/|$)`)
+
+// normalizeURL returns the route of uri: its path without the query and
+// with the IDs matched by the -normalize-urls pattern replaced by {id}
+func normalizeURL(configuration *Configuration, uri string) string {
+	path := uri
+	if u, err := neturl.Parse(uri); err == nil {
+		path = u.EscapedPath()
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	if configuration.routePattern == autoRoutePattern {
+		// matches share their slashes, so adjacent IDs take two passes
+		for i := 0; i < 2; i++ {
+			path = autoRoutePattern.ReplaceAllString(path, "${1}{id}${3}")
+		}
+		return path
+	}
+	return configuration.routePattern.ReplaceAllString(path, "{id}")
+}
+
+// urlKey is what -report-errors-by-url counts uri under: its route with
+// -normalize-urls, else the URL without its query, which may be random
+func urlKey(configuration *Configuration, uri string) string {
+	if configuration.routePattern != nil {
+		return normalizeURL(configuration, uri)
+	}
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+// cacheBuster adds a random _ query parameter to uri, keeping any query
+// string and fragment it already has
+func cacheBuster(uri string, rand *rand.Rand) string {
+	fragment := ""
+	if i := strings.IndexByte(uri, '#'); i >= 0 {
+		uri, fragment = uri[:i], uri[i:]
+	}
+
+	separator := "?"
+	if strings.Contains(uri, "?") {
+		separator = "&"
+	}
+
+	return uri + separator + "_=" + strconv.FormatUint(rand.Uint64(), 36) + fragment
+}
+
+// header is a request header, a -random-header is one with either an
+// empty value, for a random one, or a value with tokens to substitute
+type header struct {
+	name  string
+	value string
+}
+
+// parseRandomHeader parses a -random-header, a name alone or a
+// "Name: value" pair
+func parseRandomHeader(spec string) (header, error) {
+	name, value := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		name, value = spec[:i], strings.TrimSpace(spec[i+1:])
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return header{}, fmt.Errorf("random header %q has no valid name", spec)
+	}
+	return header{name: name, value: value}, nil
+}
+
+// randomHeaderValues returns the -random-header headers of one request
+// of the client id
+func randomHeaderValues(configuration *Configuration, id string, rand *rand.Rand) []header {
+	headers := make([]header, len(configuration.randomHeaders))
+	for i, h := range configuration.randomHeaders {
+		headers[i].name = h.name
+		if h.value == "" {
+			headers[i].value = strconv.FormatUint(rand.Uint64(), 36)
+		} else {
+			headers[i].value = uriReplacer(h.value, id, rand)
+		}
+	}
+	return headers
+}
+
+func uriReplacer(s string, id string, rand *rand.Rand) string {
+	r := strings.NewReplacer("<UUID>", newUUID(rand), "<CID>", id)
+	return r.Replace(s)
+}
+
+// pause sleeps for d, or until the run is stopped
+func pause(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-runCtx.Done():
+	}
+}
+
+// retryAfter parses a Retry-After header, given either in seconds or as an
+// HTTP date, it returns 0 when there is no usable delay
+func retryAfter(value []byte) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(string(value)); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(string(value)); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// retryCapWarned is set once a Retry-After delay over the cap has been
+// logged, the next ones are cut without a word
+var retryCapWarned int32
+
+// retryWait returns how long a client waits on the Retry-After header value
+// of a 429 response: the delay asked for, but no longer than -max-retry-after
+// nor the -t or -max-duration of the run. The first cut delay is logged.
+func retryWait(configuration *Configuration, value []byte) time.Duration {
+	wait := retryAfter(value)
+	limit := configuration.maxRetryAfter
+	if run := runLimit(); run > 0 && (limit <= 0 || run < limit) {
+		limit = run
+	}
+	if limit > 0 && wait > limit {
+		if atomic.CompareAndSwapInt32(&retryCapWarned, 0, 1) {
+			logger.Warn("Retry-After delay over the cap, waiting less", "retry_after", wait, "cap", limit)
+		}
+		wait = limit
+	}
+	return wait
+}
+
+// methodHasBody reports whether requests of method normally carry a body
+func methodHasBody(method string) bool {
+	switch strings.ToUpper(method) {
+	case "POST", "PUT", "PATCH":
+		return true
+	}
+	return false
+}
+
+// isRedirect reports whether status is a 3xx redirect
+func isRedirect(status int) bool {
+	return status >= 300 && status < 400
+}
+
+// sendsBody reports whether requests of method carry the POST data
+func sendsBody(configuration *Configuration, method string) bool {
+	if configuration.getBody && strings.EqualFold(method, "GET") {
+		return true
+	}
+	return configuration.forceBody || methodHasBody(method)
+}
+
+// setRequestBody sets body as the body of the fasthttp request req of
+// method, streamed for -multipart-stream, -chunked and -content-length.
+// Methods that send no body, see sendsBody, get none of them, not even an
+// empty stream.
+func setRequestBody(configuration *Configuration, req *fasthttp.Request, method string, body []byte) {
+	if !sendsBody(configuration, method) {
+		return
+	}
+
+	if configuration.multipartSize > 0 {
+		upload := newMultipartUpload(configuration.multipartSize)
+		req.Header.Set("Content-Type", upload.contentType())
+		req.SetBodyStream(upload, int(upload.size()))
+	} else if configuration.chunked {
+		// a negative size makes fasthttp omit Content-Length and chunk the body
+		req.SetBodyStream(bytes.NewReader(body), -1)
+	} else if configuration.contentLength >= 0 {
+		// fasthttp sends the stream size as Content-Length, whatever the body
+		req.SetBodyStream(bytes.NewReader(body), configuration.contentLength)
+	} else {
+		req.SetBody(body)
+	}
+}
+
+// set once the heap outgrows -max-memory, no latency samples are kept
+// from then on
+var samplesCapped int32
+
+// keepSamples reports whether latency samples are still being kept
+func keepSamples() bool {
+	return atomic.LoadInt32(&samplesCapped) == 0
+}
+
+// latencyWindow collects the latencies of the current window of
+// -window-csv or -influx-interval, apart from the cumulative ones. Each
+// client adds to a shard of its own, so that clients don't wait on each
+// other to record a request, and take merges the shards when the window
+// ends.
+type latencyWindow struct {
+	shardsMu sync.Mutex
+	shards   []*windowShard
+}
+
+// windowShard holds the latencies of one client in the current window
+type windowShard struct {
+	mu      sync.Mutex
+	samples []float64
+}
+
+// shard returns a new shard of w, for a new client
+func (w *latencyWindow) shard() *windowShard {
+	shard := &windowShard{}
+	w.shardsMu.Lock()
+	w.shards = append(w.shards, shard)
+	w.shardsMu.Unlock()
+	return shard
+}
+
+func (s *windowShard) add(latency time.Duration) {
+	s.mu.Lock()
+	s.samples = append(s.samples, latency.Seconds())
+	s.mu.Unlock()
+}
+
+// take returns the sorted latencies of the window so far, and starts a new
+// window
+func (w *latencyWindow) take() []float64 {
+	w.shardsMu.Lock()
+	defer w.shardsMu.Unlock()
+
+	var samples []float64
+	for _, shard := range w.shards {
+		shard.mu.Lock()
+		samples = append(samples, shard.samples...)
+		shard.samples = shard.samples[:0]
+		shard.mu.Unlock()
+	}
+	sort.Float64s(samples)
+	return samples
+}
+
+// windowRecorder writes the latency percentiles of each -window to the
+// -window-csv file when the window ends
+type windowRecorder struct {
+	latencyWindow
+
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time // of the first window
+}
+
+// the -window-csv recorder, nil without it
+var windows *windowRecorder
+
+// recordersOnce starts the window recorders with the first clients
+var recordersOnce sync.Once
+
+// startRecorders starts the windows of -window-csv and -influx-interval
+// when the clients start, rather than during the setup before them
+func startRecorders() {
+	recordersOnce.Do(func() {
+		if windows != nil {
+			windows.mu.Lock()
+			windows.start = time.Now()
+			windows.mu.Unlock()
+			go windows.run(windowLength)
+		}
+		if influx != nil && influxInterval > 0 {
+			go influx.run(influxInterval)
+		}
+	})
+}
+
+// run ends a window every interval for the rest of the process
+func (w *windowRecorder) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.flush(false)
+	}
+}
+
+// flush writes a line for the window so far and starts a new one, unless
+// the window is empty and skipEmpty is set. The line is stamped with the
+// seconds since the first window started.
+func (w *windowRecorder) flush(skipEmpty bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	samples := w.take()
+	if skipEmpty && len(samples) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w.file, "%.0f,%d,%f,%f,%f,%f\n", time.Since(w.start).Seconds(), len(samples),
+		percentile(samples, 50), percentile(samples, 95), percentile(samples, 99), percentile(samples, 100))
+}
+
+// elapseChunk is the least a Result grows its latency samples by
+const elapseChunk = 1024
+
+// maxPresize bounds the latency samples allocated up front for all the
+// clients together, 32 MB of them. A client's share of it is a start, its
+// samples grow in chunks past it.
+const maxPresize = 1 << 22
+
+// newResult returns the Result of a new client, with room for the latency
+// samples of all its requests when -r bounds them. Otherwise the samples
+// grow in chunks as they come. -max-samples is shared out evenly over the
+// clients, each one keeps a reservoir of its part.
+func newResult(configuration *Configuration) *Result {
+	result := &Result{}
+	if windows != nil {
+		result.windowShard = windows.shard()
+	}
+	if influx != nil && influxInterval > 0 {
+		result.influxShard = influx.shard()
+	}
+	if configuration.maxSamples > 0 {
+		result.reservoir = configuration.maxSamples / int64(clients)
+		if result.reservoir < 1 {
+			result.reservoir = 1
+		}
+	}
+
+	if requests != -1 && !noLatency {
+		size := configuration.requests
+		if clients > 0 && size > maxPresize/int64(clients) {
+			size = maxPresize / int64(clients)
+		}
+		if result.reservoir > 0 && size > result.reservoir {
+			size = result.reservoir
+		}
+		result.elapse = make([]float64, 0, size)
+	}
+	return result
+}
+
+// startTiming is when a request starts, or the zero time with -no-latency
+// when requests aren't timed
+func startTiming() time.Time {
+	if noLatency {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// elapsedSince is the latency of a request started at start, 0 when it
+// wasn't timed
+func elapsedSince(start time.Time) time.Duration {
+	if start.IsZero() {
+		return 0
+	}
+	return time.Since(start)
+}
+
+// recordLatency keeps one request latency in result, or only counts it
+// once samples are no longer kept. rand is the client's, for -max-samples.
+func recordLatency(result *Result, latency time.Duration, rand *rand.Rand) {
+	if noLatency {
+		return
+	}
+	if result.windowShard != nil {
+		result.windowShard.add(latency)
+	}
+	if result.influxShard != nil {
+		result.influxShard.add(latency)
+	}
+	if rpsTarget > 0 {
+		atomic.AddInt64(&targetDone, 1)
+		atomic.AddInt64(&targetLatency, int64(latency))
+	}
+
+	if maxMemory > 0 {
+		result.countLatency(latency.Seconds())
+	}
+	if !keepSamples() {
+		result.samplesDropped++
+		return
+	}
+	if result.reservoir > 0 {
+		// Algorithm R: once the reservoir is full, the n-th latency takes
+		// the place of a random one with probability reservoir/n
+		result.samplesSeen++
+		if int64(len(result.elapse)) >= result.reservoir {
+			if i := rand.Int63n(result.samplesSeen); i < result.reservoir {
+				result.elapse[i] = latency.Seconds()
+			}
+			return
+		}
+	}
+	if len(result.elapse) == cap(result.elapse) {
+		// append grows large slices by only 1.25x, long runs would copy
+		// their samples over and over
+		grown := make([]float64, len(result.elapse), 2*len(result.elapse)+elapseChunk)
+		copy(grown, result.elapse)
+		result.elapse = grown
+	}
+	result.elapse = append(result.elapse, latency.Seconds())
+}
+
+// countLatency adds latency, in seconds, to the histogram of result
+func (result *Result) countLatency(latency float64) {
+	i := histogramIndex(latency)
+	if i >= len(result.histogram) {
+		grown := make([]int64, i+1, 2*i+1)
+		copy(grown, result.histogram)
+		result.histogram = grown
+	}
+	result.histogram[i]++
+	if latency > result.latencyMax {
+		result.latencyMax = latency
+	}
+}
+
+// setStreamedLatencies sets the latency percentiles, max and histogram of
+// summary from the histograms of results, which count every latency of
+// the run, for when -max-memory stopped keeping the samples. The mean and
+// stddev stay those of the samples kept.
+func setStreamedLatencies(summary *Summary, results map[int]*Result) {
+	var counts []int64
+	summary.LatencyMax = 0
+	for _, result := range results {
+		for i, count := range result.histogram {
+			if i >= len(counts) {
+				counts = append(counts, make([]int64, i+1-len(counts))...)
+			}
+			counts[i] += count
+		}
+		if result.latencyMax > summary.LatencyMax {
+			summary.LatencyMax = result.latencyMax
+		}
+	}
+
+	summary.LatencyHistogram = nil
+	for i, count := range counts {
+		if count > 0 {
+			summary.LatencyHistogram = append(summary.LatencyHistogram, HistogramBucket{Le: histogramBound(i), Count: count})
+		}
+	}
+	// a bucket bound can be over the largest latency in the bucket
+	summary.LatencyP50 = math.Min(histogramPercentile(summary.LatencyHistogram, 50), summary.LatencyMax)
+	summary.LatencyP90 = math.Min(histogramPercentile(summary.LatencyHistogram, 90), summary.LatencyMax)
+	summary.LatencyP99 = math.Min(histogramPercentile(summary.LatencyHistogram, 99), summary.LatencyMax)
+	summary.LatencyStreamed = true
+}
+
+// watchMemory checks the heap size every few seconds and stops keeping
+// latency samples the first time it is over limit bytes. The samples are
+// what grows with the length of a run, the counters stay the same size.
+func watchMemory(limit uint64) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var stats runtime.MemStats
+	for range ticker.C {
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc > limit {
+			logger.Warn("heap over -max-memory, latency samples are no longer kept", "heap_mb", stats.HeapAlloc>>20)
+			atomic.StoreInt32(&samplesCapped, 1)
+			return
+		}
+	}
+}
+
+// maxSlowWarnings is the most slow requests -warn-slow logs in a second
+const maxSlowWarnings = 5
+
+// the -warn-slow warnings of the current second, guarded by slowMu
+var slowMu sync.Mutex
+var slowSecond time.Time
+var slowWarned int
+var slowSuppressed int
+
+// warnIfSlow logs the request to uri when it took longer than
+// -warn-slow. Past maxSlowWarnings a second, the warnings are only counted
+// and summed up in the next second's first one, so a general slowdown
+// doesn't flood the output.
+func warnIfSlow(configuration *Configuration, uri string, status int, latency time.Duration) {
+	if configuration.warnSlow <= 0 || latency <= configuration.warnSlow {
+		return
+	}
+
+	slowMu.Lock()
+	defer slowMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(slowSecond) >= time.Second {
+		if slowSuppressed > 0 {
+			logger.Warn("slow requests not logged", "count", slowSuppressed)
+		}
+		slowSecond, slowWarned, slowSuppressed = now, 0, 0
+	}
+
+	if slowWarned >= maxSlowWarnings {
+		slowSuppressed++
+		return
+	}
+	slowWarned++
+	logger.Warn("slow request", "url", uri, "latency", latency, "status", status)
+}
+
+// fastWarned is set once a response faster than -min-expected-latency
+// has been logged, the next ones are only counted
+var fastWarned int32
+
+// checkTooFast counts the response to uri in result when it came back
+// faster than -min-expected-latency, the first one is also logged. Such
+// responses usually come from a cache, a mock or the wrong host, and make
+// the latencies look better than the backend is.
+func checkTooFast(configuration *Configuration, result *Result, uri string, status int, err error, latency time.Duration) {
+	if configuration.minLatency <= 0 || err != nil || latency >= configuration.minLatency {
+		return
+	}
+
+	result.tooFast++
+	if atomic.CompareAndSwapInt32(&fastWarned, 0, 1) {
+		logger.Warn("response faster than -min-expected-latency, it may not have reached the backend", "url", uri, "latency", latency, "status", status)
+	}
+}
+
+// of the first -fail-fast-connect requests: how many have ended, and
+// whether any of them connected
+var earlyRequests int64
+var earlyConnected int32
+
+// isConnectError reports whether err is a failure to look the target up
+// or to connect to it, rather than a failure of an open connection
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// networkErrorKind sorts a network error into a few broad kinds for the
+// -fail-on-network-errors breakdown
+func networkErrorKind(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, errRequestTimeout), errors.Is(err, errFirstByteTimeout),
+		errors.Is(err, fasthttp.ErrTimeout), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return portsExhausted
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, fasthttp.ErrConnectionClosed):
+		return "connection closed"
+	case errors.As(err, &certErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.Is(err, fasthttp.ErrNoFreeConns):
+		return "no free connection"
+	}
+	return "other"
+}
+
+// portsExhausted is the kind of the "cannot assign requested address"
+// connect errors, when no local port is left to connect from
+const portsExhausted = "ephemeral ports exhausted"
+
+// set once the exhaustion of the ephemeral ports has been logged
+var portsWarned int32
+
+// countNetworkError counts a request that failed with the network error err
+func countNetworkError(result *Result, err error) {
+	result.networkFailed++
+
+	kind := networkErrorKind(err)
+	if kind == portsExhausted && atomic.CompareAndSwapInt32(&portsWarned, 0, 1) {
+		logger.Warn("out of ephemeral ports, connections can't get a local port (cannot assign requested address): "+
+			"reuse connections (keep-alive, -conns-per-host) or dial from more addresses with -local-addr", "err", err)
+	}
+
+	result.mu.Lock()
+	defer result.mu.Unlock()
+	if result.networkErrors == nil {
+		result.networkErrors = make(map[string]int64)
+	}
+	result.networkErrors[kind]++
+}
+
+// checkNetworkErrors exits with status 1 after printing the network errors
+// by kind when -fail-on-network-errors is set and there were any
+func checkNetworkErrors(summary *Summary) {
+	if !failOnNetErrors || summary.NetworkFailed == 0 {
+		return
+	}
+
+	kinds := make([]string, 0, len(summary.NetworkErrors))
+	for kind := range summary.NetworkErrors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	fmt.Fprintf(os.Stderr, "\nFailing the run on %d network errors (-fail-on-network-errors):\n", summary.NetworkFailed)
+	for _, kind := range kinds {
+		fmt.Fprintf(os.Stderr, "  %-30s%10d hits\n", kind, summary.NetworkErrors[kind])
+	}
+	os.Exit(1)
+}
+
+// failFast exits once the first -fail-fast-connect requests have all ended
+// in connect errors, err being the error of a request that just ended
+func failFast(configuration *Configuration, err error) {
+	if configuration.failFastConnect <= 0 {
+		return
+	}
+
+	// mark the success before counting the request, so the request that
+	// completes the first K sees every success among them
+	if !isConnectError(err) {
+		atomic.StoreInt32(&earlyConnected, 1)
+	}
+
+	n := atomic.AddInt64(&earlyRequests, 1)
+	if n == configuration.failFastConnect && atomic.LoadInt32(&earlyConnected) == 0 {
+		logger.Error("target unreachable, the first requests all failed to connect", "requests", n, "err", err)
+		os.Exit(1)
+	}
+}
+
+// claimRequest takes one request out of the global -n budget, it returns
+// false once the budget is used up (or always true when there is no budget).
+// Clients claim a single request right before sending it, never a batch, so
+// every client keeps a request in flight until the budget runs dry and the
+// tail of the run still has the full concurrency.
+func claimRequest(configuration *Configuration) bool {
+	if configuration.totalRequests <= 0 {
+		return true
+	}
+	return atomic.AddInt64(&issuedRequests, 1) <= configuration.totalRequests
+}
+
+// pacer spaces out the requests of one client so that all clients together
+// offer -rate requests per second
+type pacer struct {
+	interval time.Duration
+	poisson  bool
+	next     time.Time
+	noBurst  bool // don't catch up on requests that are late
+
+	// with a -rate-start/-rate-end ramp the interval follows the rate
+	configuration *Configuration
+}
+
+func newPacer(configuration *Configuration) *pacer {
+	p := &pacer{poisson: configuration.arrival == "poisson"}
+	if configuration.rate > 0 {
+		p.interval = time.Duration(float64(clients) / configuration.rate * float64(time.Second))
+	}
+	if configuration.rampDuration > 0 {
+		p.configuration = configuration
+	}
+	if configuration.rpsTarget > 0 {
+		// a client that was parked or fell behind doesn't catch up, the
+		// controller brings in more clients instead
+		p.configuration = configuration
+		p.noBurst = true
+	}
+	return p
+}
+
+// newClientLimiter returns the pacer holding one client to -client-rate.
+// It is a cap rather than a target, so a client that falls behind it
+// doesn't send its late requests at once.
+func newClientLimiter(configuration *Configuration) *pacer {
+	p := &pacer{noBurst: true}
+	if configuration.clientRate > 0 {
+		p.interval = time.Duration(float64(time.Second) / configuration.clientRate)
+	}
+	return p
+}
+
+// wait blocks until the next request of the client is due. With poisson
+// arrivals the gaps are drawn from an exponential distribution with the same
+// mean as the uniform interval.
+func (p *pacer) wait(rand *rand.Rand) {
+	interval := p.interval
+	if p.configuration != nil && p.configuration.rpsTarget > 0 {
+		// the active clients share the target rate
+		interval = time.Duration(float64(atomic.LoadInt64(&activeClients)) / p.configuration.rpsTarget * float64(time.Second))
+	} else if p.configuration != nil {
+		interval = time.Duration(float64(clients) / rampRate(p.configuration, time.Since(startTime)) * float64(time.Second))
+	}
+	if interval <= 0 {
+		return
+	}
+
+	if p.next.IsZero() {
+		p.next = time.Now()
+	}
+
+	gap := interval
+	if p.poisson {
+		gap = time.Duration(rand.ExpFloat64() * float64(interval))
+	}
+	p.next = p.next.Add(gap)
+	if now := time.Now(); p.noBurst && p.next.Before(now) {
+		// late already: send now, but don't build up a backlog
+		p.next = now
+	}
+
+	pause(time.Until(p.next))
+}
+
+// -rps-target state: the clients allowed to send, the first activeClients
+// by id (atomic), and the requests sent each second, guarded by targetMu
+var activeClients int64
+var targetMu sync.Mutex
+var targetRates []float64
+
+// the requests sent, and the count and total latency (in ns) of the ones
+// completed, since holdTargetRate last looked (atomic)
+var targetSent, targetDone, targetLatency int64
+
+// targetHeadroom is the spare capacity holdTargetRate keeps, so that a
+// latency spike doesn't drop the rate straight away
+const targetHeadroom = 1.25
+
+// a target rate counts as held when the last heldSeconds of the run reach
+// targetTolerance of it
+const heldSeconds = 5
+const targetTolerance = 0.95
+
+// holdTargetRate is the -rps-target controller: every second it sets the
+// number of active clients by Little's law, the target rate times the mean
+// latency of the last second (with headroom), within 1 and -c. The pacer
+// spreads the target over the active clients.
+func holdTargetRate(configuration *Configuration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sent := atomic.SwapInt64(&targetSent, 0)
+		done := atomic.SwapInt64(&targetDone, 0)
+		latency := atomic.SwapInt64(&targetLatency, 0)
+
+		targetMu.Lock()
+		targetRates = append(targetRates, float64(sent))
+		targetMu.Unlock()
+
+		active := atomic.LoadInt64(&activeClients)
+		if done == 0 {
+			// slower than a second, or not started: no latency to go by
+			active *= 2
+		} else {
+			mean := time.Duration(latency / done).Seconds()
+			active = int64(math.Ceil(configuration.rpsTarget * mean * targetHeadroom))
+		}
+		if active < 1 {
+			active = 1
+		}
+		if active > int64(clients) {
+			active = int64(clients)
+		}
+		atomic.StoreInt64(&activeClients, active)
+	}
+}
+
+// heldRate is the mean rate of the last heldSeconds seconds of -rps-target
+func heldRate() float64 {
+	targetMu.Lock()
+	defer targetMu.Unlock()
+
+	last := targetRates
+	if len(last) > heldSeconds {
+		last = last[len(last)-heldSeconds:]
+	}
+	mean, _ := meanStddev(last)
+	return mean
+}
+
+// waitActive parks a client until holdTargetRate lets it send, it returns
+// false when the run ends first
+func waitActive(clientID int) bool {
+	for int64(clientID) >= atomic.LoadInt64(&activeClients) {
+		if runCtx.Err() != nil {
+			return false
+		}
+		pause(100 * time.Millisecond)
+	}
+	return true
+}
+
+// rampRate is the rate offered after elapsed into a -rate-start/-rate-end
+// ramp, climbing linearly over the run
+func rampRate(configuration *Configuration, elapsed time.Duration) float64 {
+	progress := math.Min(float64(elapsed)/float64(configuration.rampDuration), 1)
+	return configuration.rateStart + (configuration.rateEnd-configuration.rateStart)*progress
+}
+
+// rampWindow holds the requests that ended in one second of a rate ramp
+type rampWindow struct {
+	offered   float64 // the rate at the start of the second
+	requests  int64
+	failed    int64
+	latencies []float64
+}
+
+// the seconds of a rate ramp in order, guarded by rampMu
+var rampMu sync.Mutex
+var rampWindows []*rampWindow
+
+// recordRamp adds one request that ended now to its second of the ramp.
+// Latencies are only kept for the -target-p99 threshold.
+func recordRamp(configuration *Configuration, ok bool, latency time.Duration) {
+	second := int(time.Since(startTime) / time.Second)
+
+	rampMu.Lock()
+	defer rampMu.Unlock()
+
+	for len(rampWindows) <= second {
+		start := time.Duration(len(rampWindows)) * time.Second
+		rampWindows = append(rampWindows, &rampWindow{offered: rampRate(configuration, start)})
+	}
+	window := rampWindows[second]
+	window.requests++
+	if !ok {
+		window.failed++
+	}
+	if targetP99 > 0 && keepSamples() {
+		window.latencies = append(window.latencies, latency.Seconds())
+	}
+}
+
+// rampThresholds returns the rates offered in the first second of the ramp
+// whose error rate went over -ramp-max-errors and whose p99 went over
+// -target-p99, 0 when that never happened
+func rampThresholds() (errorRate float64, latencyRate float64) {
+	rampMu.Lock()
+	defer rampMu.Unlock()
+
+	for _, window := range rampWindows {
+		if window.requests == 0 {
+			continue
+		}
+
+		if errorRate == 0 && float64(window.failed)/float64(window.requests)*100 > rampMaxErrors {
+			errorRate = window.offered
+		}
+
+		if latencyRate == 0 && len(window.latencies) > 0 {
+			sort.Float64s(window.latencies)
+			if percentile(window.latencies, 99) > targetP99.Seconds() {
+				latencyRate = window.offered
+			}
+		}
+	}
+	return errorRate, latencyRate
+}
+
+// think draws the think time of a client before its next request from the
+// -think-dist distribution
+func think(configuration *Configuration, rand *rand.Rand) time.Duration {
+	switch configuration.thinkDist {
+	case "uniform":
+		spread := configuration.thinkMax - configuration.thinkMin
+		if spread <= 0 {
+			return configuration.thinkMin
+		}
+		return configuration.thinkMin + time.Duration(rand.Int63n(int64(spread)+1))
+	case "exponential":
+		return time.Duration(rand.ExpFloat64() * float64(configuration.thinkTime))
+	case "normal":
+		// a negative draw is no think time at all
+		d := time.Duration(rand.NormFloat64()*float64(configuration.thinkStddev)) + configuration.thinkTime
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+	return configuration.thinkTime
+}
+
+// captureResponseHeaders counts the value of each -capture-header in resp,
+// only the named headers are looked up
+func captureResponseHeaders(configuration *Configuration, result *Result, resp *fasthttp.Response) {
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	if result.capturedHeaders == nil {
+		result.capturedHeaders = make(map[string]map[string]int64)
+	}
+
+	for _, name := range configuration.captureHeaders {
+		value := "<missing>"
+		if v := resp.Header.Peek(name); v != nil {
+			value = string(v)
+		}
+
+		if result.capturedHeaders[name] == nil {
+			result.capturedHeaders[name] = make(map[string]int64)
+		}
+		result.capturedHeaders[name][value]++
+	}
+}
+
+// checksBody reports whether response bodies are checked or extracted
+// from, they must then be read in full
+func (c *Configuration) checksBody() bool {
+	return c.schema != nil || c.bodyRegex != nil || c.bodySHA256 != nil || len(c.extracts) > 0
+}
+
+// checkBody returns why the body of a 200 response fails the checks of
+// configuration, nil when it passes
+func checkBody(configuration *Configuration, body []byte) error {
+	if configuration.schema != nil {
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			return fmt.Errorf("invalid JSON: %s", err)
+		}
+		if err := configuration.schema.validate(value, "$"); err != nil {
+			return err
+		}
+	}
+	if configuration.bodyRegex != nil && !configuration.bodyRegex.Match(body) {
+		return fmt.Errorf("body does not match %s", configuration.bodyRegex)
+	}
+	if configuration.bodySHA256 != nil {
+		if sum := sha256.Sum256(body); !bytes.Equal(sum[:], configuration.bodySHA256) {
+			return fmt.Errorf("body SHA-256 is %x", sum)
+		}
+	}
+	return nil
+}
+
+// jsonSchema is the subset of JSON Schema checked by -schema: type, enum,
+// required, properties, additionalProperties (false only), items, minimum,
+// maximum, minLength, maxLength, minItems, maxItems and pattern. Other
+// keywords fail loading the schema, short of the annotations, which are
+// read and left alone.
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"` // a name or a list of names
+	Enum                 []interface{}          `json:"enum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties interface{}            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Pattern              string                 `json:"pattern"`
+
+	// annotations, which don't take part in validation
+	SchemaURI   interface{} `json:"$schema"`
+	ID          interface{} `json:"$id"`
+	Comment     interface{} `json:"$comment"`
+	Title       interface{} `json:"title"`
+	Description interface{} `json:"description"`
+	Default     interface{} `json:"default"`
+	Examples    interface{} `json:"examples"`
+
+	pattern *regexp.Regexp
+}
+
+// loadSchema reads a JSON Schema file and compiles its patterns once
+func loadSchema(path string) (*jsonSchema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// a keyword that isn't checked would pass every response unnoticed
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	schema := &jsonSchema{}
+	if err := decoder.Decode(schema); err != nil {
+		if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+			return nil, fmt.Errorf("unsupported keyword %s", field)
+		}
+		return nil, err
+	}
+
+	return schema, schema.compile()
+}
+
+func (s *jsonSchema) compile() error {
+	if _, ok := s.AdditionalProperties.(bool); s.AdditionalProperties != nil && !ok {
+		return errors.New("additionalProperties must be true or false, a schema for it is not supported")
+	}
+
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = pattern
+	}
+
+	for _, property := range s.Properties {
+		if err := property.compile(); err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// hasType reports whether value is of the JSON type name
+func hasType(value interface{}, name string) bool {
+	switch v := value.(type) {
+	case nil:
+		return name == "null"
+	case bool:
+		return name == "boolean"
+	case float64:
+		return name == "number" || (name == "integer" && v == math.Trunc(v))
+	case string:
+		return name == "string"
+	case []interface{}:
+		return name == "array"
+	case map[string]interface{}:
+		return name == "object"
+	}
+	return false
+}
+
+// validate returns the first way value, found at path, fails the schema
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	switch t := s.Type.(type) {
+	case string:
+		if !hasType(value, t) {
+			return fmt.Errorf("%s: not of type %s", path, t)
+		}
+	case []interface{}:
+		matched := false
+		for _, name := range t {
+			if name, ok := name.(string); ok && hasType(value, name) {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: not of any type %v", path, t)
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		matched := false
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(value, allowed) {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: not one of %v", path, s.Enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %v is less than %v", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %v is more than %v", path, v, *s.Maximum)
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s: longer than %d", path, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match %s", path, s.Pattern)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: more than %d items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", path, name)
+			}
+		}
+		for name, property := range v {
+			if schema, ok := s.Properties[name]; ok {
+				if err := schema.validate(property, path+"."+name); err != nil {
+					return err
+				}
+			} else if s.AdditionalProperties == false {
+				return fmt.Errorf("%s: unexpected property %s", path, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// failureLog writes failed requests to the -log-failures file, up to max of
+// them. Clients share it, so writes are serialized.
+type failureLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	max    int
+	logged int
+}
+
+// write logs req and, unless it failed with the network error err, resp
+func (l *failureLog) write(req *fasthttp.Request, resp *fasthttp.Response, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.logged >= l.max {
+		return
+	}
+	l.logged++
+
+	reason := fmt.Sprintf("status code %d", resp.StatusCode())
+	if err != nil {
+		reason = err.Error()
+	}
+
+	fmt.Fprintf(l.file, "=== Failure %d: %s %s (%s)\n", l.logged, req.Header.Method(), req.URI().String(), reason)
+	l.file.Write(req.Header.Header())
+	l.file.Write(printableBody(req.Body()))
+	fmt.Fprintln(l.file)
+
+	if err == nil {
+		fmt.Fprintln(l.file, "---")
+		l.file.Write(resp.Header.Header())
+		l.file.Write(printableBody(resp.Body()))
+		fmt.Fprintln(l.file)
+	}
+	fmt.Fprintln(l.file)
+}
+
+// ErrorSample is the first failed request of one kind of failure, kept
+// with -keep-errors-sample
+type ErrorSample struct {
+	Failure string `json:"failure"`
+	Count   int64  `json:"count"`
+	Example string `json:"example"`
+}
+
+// errorSamples keeps one ErrorSample per kind of failure, for up to max
+// kinds, so that a run failing in many ways stays small. Clients share it.
+type errorSamples struct {
+	mu      sync.Mutex
+	max     int
+	samples []*ErrorSample
+	byKind  map[string]*ErrorSample
+}
+
+// failureSamples are the -keep-errors-sample examples, nil without the flag
+var failureSamples *errorSamples
+
+// add counts a failure of kind. example is only called for the first
+// failure of a kind, so the others don't pay for copying their body.
+func (s *errorSamples) add(kind string, example func() string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sample := s.byKind[kind]; sample != nil {
+		sample.Count++
+		return
+	}
+	if len(s.samples) >= s.max {
+		return
+	}
+	sample := &ErrorSample{Failure: kind, Count: 1, Example: example()}
+	s.byKind[kind] = sample
+	s.samples = append(s.samples, sample)
+}
+
+// list returns a copy of the samples, in the order of their first failure
+func (s *errorSamples) list() []ErrorSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := make([]ErrorSample, len(s.samples))
+	for i, sample := range s.samples {
+		samples[i] = *sample
+	}
+	return samples
+}
+
+// sampleFailure adds a failed fasthttp request to the -keep-errors-sample
+// examples, with why it failed and its response (nil after a network error)
+func sampleFailure(kind string, reason string, req *fasthttp.Request, resp *fasthttp.Response) {
+	if failureSamples == nil {
+		return
+	}
+	failureSamples.add(kind, func() string {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%s %s (%s)\n", req.Header.Method(), req.URI().String(), reason)
+		if resp != nil {
+			b.Write(resp.Header.Header())
+			b.Write(printableBody(resp.Body()))
+		}
+		return b.String()
+	})
+}
+
+// sampleNetHTTPFailure is sampleFailure for -backend net/http, which only
+// keeps the response body when it is checked
+func sampleNetHTTPFailure(kind string, reason string, method string, uri string, body []byte) {
+	if failureSamples == nil {
+		return
+	}
+	failureSamples.add(kind, func() string {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%s %s (%s)\n", method, uri, reason)
+		b.Write(printableBody(body))
+		return b.String()
+	})
+}
+
+// printableBody cuts body to -max-body-print bytes, noting its full size
+func printableBody(body []byte) []byte {
+	if maxBodyPrint <= 0 || len(body) <= maxBodyPrint {
+		return body
+	}
+	return append(body[:maxBodyPrint:maxBodyPrint], fmt.Sprintf("... (%d bytes)", len(body))...)
+}
+
+// discardResponseBody drains a streamed response body through buf, so the
+// body is read off the connection without ever being held in memory
+func discardResponseBody(resp *fasthttp.Response, buf []byte) error {
+	if stream := resp.BodyStream(); stream != nil {
+		if _, err := io.CopyBuffer(io.Discard, stream, buf); err != nil {
+			resp.CloseBodyStream()
+			return err
+		}
+	}
+	return resp.CloseBodyStream()
+}
+
+// runCheck sends the single request of -check with one client, which
+// prints it along with the response. It exits with status 1 when the
+// request did not succeed.
+func runCheck(configuration *Configuration) {
+	configuration.requests = 1
+	configuration.warmupRequests = 0
+	configuration.rpsTarget = 0
+	configuration.discardBody = false
+	configuration.myClient.StreamResponseBody = false
+	// a client sends one request per URL of a -f file, check the first
+	if !configuration.randomize && len(configuration.urls) > 1 {
+		configuration.urls = configuration.urls[:1]
+	}
+
+	var done sync.WaitGroup
+	done.Add(1)
+	result := newResult(configuration)
+	client(configuration, result, "0", &done)
+
+	if result.success == 0 {
+		os.Exit(1)
+	}
+}
+
+// printCheck prints the request of -check and its response (or error) as
+// they went over the wire, bodies in full
+func printCheck(req *fasthttp.Request, resp *fasthttp.Response, err error) {
+	os.Stdout.Write(req.Header.Header())
+	if !req.IsBodyStream() {
+		os.Stdout.Write(req.Body())
+	}
+	fmt.Println("\n---")
+
+	if err != nil {
+		fmt.Printf("Request failed: %s\n", err)
+		return
+	}
+	os.Stdout.Write(resp.Header.Header())
+	os.Stdout.Write(resp.Body())
+	fmt.Println()
+}
+
+// multipartBoundary separates the parts of -multipart-stream uploads
+const multipartBoundary = "gobench-multipart-boundary"
+
+// multipartFiller is what the generated files of -multipart-stream are
+// made of, repeated
+var multipartFiller = bytes.Repeat([]byte("gobench multipart upload filler\n"), 1024)
+
+// multipartBytes counts the bytes of -multipart-stream bodies read by the
+// clients, across clients
+var multipartBytes int64
+
+// multipartUpload generates a multipart/form-data body with a single file
+// of fileSize bytes as it is read, so that uploads of any size take no
+// more memory than a small one
+type multipartUpload struct {
+	head     *bytes.Reader
+	tail     *bytes.Reader
+	fileSize int64
+	sent     int64
+}
+
+func newMultipartUpload(fileSize int64) *multipartUpload {
+	head := "--" + multipartBoundary + "\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"gobench.bin\"\r\n" +
+		"Content-Type: application/octet-stream\r\n\r\n"
+	tail := "\r\n--" + multipartBoundary + "--\r\n"
+	return &multipartUpload{
+		head:     bytes.NewReader([]byte(head)),
+		tail:     bytes.NewReader([]byte(tail)),
+		fileSize: fileSize,
+	}
+}
+
+// size is the length of the whole body, sent as its Content-Length
+func (u *multipartUpload) size() int64 {
+	return u.head.Size() + u.fileSize + u.tail.Size()
+}
+
+func (u *multipartUpload) contentType() string {
+	return "multipart/form-data; boundary=" + multipartBoundary
+}
+
+func (u *multipartUpload) Read(p []byte) (int, error) {
+	var n int
+	switch {
+	case u.head.Len() > 0:
+		n, _ = u.head.Read(p)
+	case u.sent < u.fileSize:
+		if left := u.fileSize - u.sent; int64(len(p)) > left {
+			p = p[:left]
+		}
+		for n < len(p) {
+			n += copy(p[n:], multipartFiller[(u.sent+int64(n))%int64(len(multipartFiller)):])
+		}
+		u.sent += int64(n)
+	default:
+		var err error
+		n, err = u.tail.Read(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	atomic.AddInt64(&multipartBytes, int64(n))
+	return n, nil
+}
+
+func client(configuration *Configuration, result *Result, id string, done *sync.WaitGroup) {
+	clientID, _ := strconv.Atoi(id)
+	source := time.Now().UnixNano()
+	if seed != 0 {
+		// every client repeats its own sequence, whatever the others do
+		source = seed + int64(clientID)
+	}
+	rand := rand.New(rand.NewSource(source))
+	urlTemplate := clientTemplate(configuration.urlTemplate, rand)
+	bodyTemplate := clientTemplate(configuration.bodyTemplate, rand)
+	pacer := newPacer(configuration)
+	limiter := newClientLimiter(configuration)
+	doer := configuration.clientDoer(clientID)
+
+	defer done.Done()
+
+	atomic.AddInt64(&runningClients, 1)
+	defer atomic.AddInt64(&runningClients, -1)
+
+	result.recordMu.Lock()
+	defer result.recordMu.Unlock()
+
+	var bodyBuffer, urlBuffer bytes.Buffer
+
+	var discardBuffer []byte
+	if configuration.discardBody {
+		discardBuffer = make([]byte, 32*1024)
+	}
+
+	if configuration.websocket {
+		wsClient(configuration, result, rand, pacer)
+		return
+	}
+
+	// no think time before the first request of the client
+	thinking := false
+
+	// failed requests seen so far, to back off after a new one
+	var lastFailed int64
+
+	// -extract values, carried from one response of the client to its next
+	// requests
+	var vars map[string]string
+	if len(configuration.extracts) > 0 {
+		vars = make(map[string]string)
+	}
+
+requestLoop:
+	for result.requests < configuration.requests {
+		var tmpUrls []string
+		if configuration.replay != nil || configuration.urlTemplate != nil {
+			// a single request, its URL comes from the replay log or template
+			tmpUrls = []string{""}
+		} else if configuration.randomize {
+			tmpUrls = []string{pickURL(configuration, rand)}
+		} else {
+			tmpUrls = configuration.urls
+		}
+		for _, tmpUrl := range tmpUrls {
+			// -snapshot-on-signal reads the result while the client waits
+			result.recordMu.Unlock()
+			var backoff time.Duration
+			if configuration.errorBackoff > 0 && result.failed() > lastFailed {
+				lastFailed = result.failed()
+				start := time.Now()
+				pause(configuration.errorBackoff)
+				backoff = time.Since(start)
+			}
+
+			if thinking {
+				pause(think(configuration, rand))
+			}
+			thinking = true
+
+			active := configuration.rpsTarget <= 0 || waitActive(clientID)
+			if active {
+				pacer.wait(rand)
+				limiter.wait(rand)
+			}
+			result.recordMu.Lock()
+			result.backoff += backoff
+			if !active {
+				break requestLoop
+			}
+
+			// warmup requests are extra, they don't use up the -n budget
+			warming := result.warmup < configuration.warmupRequests
+
+			if runCtx.Err() != nil || (!warming && !claimRequest(configuration)) {
+				break requestLoop
+			}
+			if configuration.rpsTarget > 0 {
+				atomic.AddInt64(&targetSent, 1)
+			}
+
+			method := configuration.method
+			if configuration.replay != nil {
+				entry, ok := configuration.replay.nextEntry()
+				if !ok {
+					break requestLoop
+				}
+				tmpUrl, method = entry.url, entry.method
+			}
+
+			// URL and body templates of one request share the same data
+			var data *templateData
+			if urlTemplate != nil || bodyTemplate != nil {
+				data = newTemplateData(id, rand, vars)
+			}
+
+			if urlTemplate != nil {
+				urlBuffer.Reset()
+				if err := urlTemplate.Execute(&urlBuffer, data); err != nil {
+					logger.Error("URL template failed", "err", err)
+				}
+				tmpUrl = urlBuffer.String()
+			}
+
+			var target string
+			if len(configuration.hosts) > 0 {
+				target = pickHost(configuration, rand)
+				tmpUrl = replaceHost(tmpUrl, target)
+			}
+
+			if configuration.grpc {
+				if warming {
+					grpcCall(configuration, tmpUrl)
+					result.warmup++
+					continue
+				}
+				grpcRequest(configuration, result, tmpUrl, rand)
+				continue
+			}
+
+			req_start := startTiming()
+			uri := tmpUrl
+			if configuration.uriSubstitution {
+				uri = uriReplacer(uri, id, rand)
+			}
+			if configuration.cacheBust {
+				uri = cacheBuster(uri, rand)
+			}
+			var headers []header
+			if len(configuration.randomHeaders) > 0 {
+				headers = randomHeaderValues(configuration, id, rand)
+			}
+
+			body := configuration.postData
+			if bodyTemplate != nil {
+				bodyBuffer.Reset()
+				if err := bodyTemplate.Execute(&bodyBuffer, data); err != nil {
+					logger.Error("body template failed", "err", err)
+				}
+				body = bodyBuffer.Bytes()
+			}
+			if !sendsBody(configuration, method) {
+				// such as the GETs of a -replay log run with -d
+				body = nil
+			}
+
+			if configuration.netHTTP {
+				if warming {
+					netHTTPCall(configuration, method, uri, body, headers, clientID, nil)
+					result.warmup++
+					continue
+				}
+				netHTTPRequest(configuration, result, method, uri, body, headers, target, clientID, vars, rand)
+				continue
+			}
+
+			req := fasthttp.AcquireRequest()
+			req.SetRequestURI(uri)
+			req.Header.SetMethodBytes([]byte(method))
+
+			if len(configuration.hostHeader) > 0 {
+				// keep dialing the URL host, only the header changes
+				req.UseHostHeader = true
+				req.Header.SetHost(configuration.hostHeader)
+			}
+
+			if len(configuration.acceptEnc) > 0 {
+				req.Header.Set("Accept-Encoding", configuration.acceptEnc)
+			}
+
+			if len(configuration.contentEnc) > 0 && len(body) > 0 {
+				req.Header.Set("Content-Encoding", configuration.contentEnc)
+			}
+
+			if len(configuration.contentType) > 0 {
+				req.Header.Set("Content-Type", configuration.contentType)
+			}
+
+			for _, h := range headers {
+				req.Header.Set(h.name, h.value)
+			}
+
+			// every Nth request of the client closes the connection it went
+			// out on. The count is per client: with the shared pool a
+			// connection may serve several clients and carry fewer or more
+			// than N requests, with -conn-strategy per-client it is exact.
+			closing := configuration.keepAliveReqs > 0 && (result.requests+1)%configuration.keepAliveReqs == 0
+			if closing {
+				req.SetConnectionClose()
+			}
+
+			if configuration.expectContinue {
+				// fasthttp sends the body without waiting for the interim
+				// response, the 100 Continue is timed from the connection
+				req.Header.Set("Expect", "100-continue")
+			}
+
+			setRequestBody(configuration, req, method, body)
+
+			if configuration.requestTimeout > 0 {
+				// on top of -tr and -tw, which bound each read and write
+				req.SetTimeout(configuration.requestTimeout)
+			}
+
+			resp := fasthttp.AcquireResponse()
+			requestTimer := startTiming()
+			err := doer.Do(req, resp)
+			if err == nil && configuration.discardBody {
+				err = discardResponseBody(resp, discardBuffer)
+			}
+			if err == nil && configuration.gzip {
+				err = gunzipBody(resp)
+			}
+			statusCode := resp.StatusCode()
+			if err == nil && logger.Enabled(runCtx, slog.LevelDebug) {
+				logger.Debug("response", "status", statusCode, "latency", elapsedSince(requestTimer))
+			}
+			if configuration.check {
+				printCheck(req, resp, err)
+			}
+			if warming {
+				result.warmup++
+				continue
+			}
+			result.requests++
+			failFast(configuration, err)
+			warnIfSlow(configuration, uri, statusCode, elapsedSince(req_start))
+			checkTooFast(configuration, result, uri, statusCode, err, elapsedSince(req_start))
+			if configuration.statsd != nil {
+				configuration.statsd.send(configuration, statusCode, elapsedSince(req_start), err)
+			}
+			if target != "" {
+				recordTarget(result, target, err == nil && statusCode == fasthttp.StatusOK, elapsedSince(req_start))
+			}
+			if configuration.routePattern != nil {
+				recordRoute(result, normalizeURL(configuration, uri), err == nil && statusCode == fasthttp.StatusOK, elapsedSince(req_start))
+			}
+			if configuration.errorsByURL {
+				recordURL(result, urlKey(configuration, uri), failureKind(statusCode, err), elapsedSince(req_start))
+			}
+			if configuration.rampDuration > 0 {
+				recordRamp(configuration, err == nil && statusCode == fasthttp.StatusOK, elapsedSince(req_start))
+			}
+			if len(configuration.captureHeaders) > 0 && err == nil {
+				captureResponseHeaders(configuration, result, resp)
+			}
+			if configuration.stopOnStatus[statusCode] && err == nil && runCtx.Err() == nil {
+				logger.Info("stopping the run on status", "status", statusCode)
+				abortRun()
+			}
+			if configuration.failureLog != nil && (err != nil || statusCode != fasthttp.StatusOK) {
+				configuration.failureLog.write(req, resp, err)
+			}
+			if err != nil {
+				logger.Warn("network error", "err", err)
+				countNetworkError(result, err)
+				sampleFailure("network error: "+networkErrorKind(err), err.Error(), req, nil)
+				if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+					result.bodyTooLarge++
+				}
+				if errors.Is(err, fasthttp.ErrNoFreeConns) {
+					result.connQueueTimeouts++
+				}
+				if configuration.requestTimeout > 0 && errors.Is(err, fasthttp.ErrTimeout) {
+					result.timedOut++
+				}
+				continue
+			}
+			if closing {
+				result.reconnects++
+			}
+			if configuration.chunked && statusCode == fasthttp.StatusLengthRequired {
+				result.chunkedRejected++
+			}
+			if configuration.honorRetryAfter && statusCode == fasthttp.StatusTooManyRequests {
+				// a well-behaved client backs off instead of failing
+				result.throttled++
+				recordLatency(result, elapsedSince(req_start), rand)
+				pause(retryWait(configuration, resp.Header.Peek("Retry-After")))
+				continue
+			}
+			if isRedirect(statusCode) {
+				result.redirects++
+			} else if statusCode != fasthttp.StatusOK {
+				result.badFailed++
+				if failureSamples != nil {
+					kind := fmt.Sprintf("status code %d", statusCode)
+					sampleFailure(kind, kind, req, resp)
+				}
+			} else if err := checkBody(configuration, resp.Body()); err != nil {
+				logger.Debug("assertion failed", "err", err)
+				result.assertionFailed++
+				sampleFailure("assertion failed", err.Error(), req, resp)
+			} else {
+				result.success++
+				if vars != nil {
+					extractVars(configuration, resp.Body(), vars)
+				}
+			}
+			recordLatency(result, elapsedSince(req_start), rand)
+		}
+	}
+}
+
+type step struct {
+	clients  int
+	duration time.Duration
+}
+
+// parseSteps parses a -steps list like "10:30s,50:1m"
+func parseSteps(spec string) ([]step, error) {
+	var steps []step
+
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid step %q, expected clients:duration", part)
+		}
+
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid client count in step %q", part)
+		}
+
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration in step %q", part)
+		}
+
+		steps = append(steps, step{clients: n, duration: d})
+	}
+
+	return steps, nil
+}
+
+// resetCounters zeroes the global counters between steps
+func resetCounters() {
+	atomic.StoreInt64(&readThroughput, 0)
+	atomic.StoreInt64(&writeThroughput, 0)
+	atomic.StoreInt64(&decodedBytes, 0)
+	atomic.StoreInt64(&multipartBytes, 0)
+	atomic.StoreInt64(&issuedRequests, 0)
+	atomic.StoreInt64(&continueResponses, 0)
+	atomic.StoreInt64(&continueDelay, 0)
+	atomic.StoreInt64(&ipv4Conns, 0)
+	atomic.StoreInt64(&ipv6Conns, 0)
+	atomic.StoreInt64(&dialedConns, 0)
+	atomic.StoreInt64(&dnsFailures, 0)
+	atomic.StoreInt64(&keepAlivePruned, 0)
+	for _, p := range proxies {
+		atomic.StoreInt64(&p.stats.Connections, 0)
+		atomic.StoreInt64(&p.stats.Failed, 0)
+	}
+
+	// openConns is a gauge, only its samples start over
+	connMu.Lock()
+	connSamples, connSum, connMin, connMax = 0, 0, 0, 0
+	connMu.Unlock()
+
+	dnsMu.Lock()
+	dnsSamples = nil
+	dnsMu.Unlock()
+
+	queueMu.Lock()
+	queueSamples = nil
+	queueSeen = 0
+	queueMu.Unlock()
+
+	portsMu.Lock()
+	for ip := range localPorts {
+		delete(localPorts, ip)
+	}
+	portsMu.Unlock()
+
+	rampMu.Lock()
+	rampWindows = nil
+	rampMu.Unlock()
+}
+
+// runRound runs n clients with fresh counters, for duration when it is not
+// zero, and returns their results. -steps and -repeat run in rounds.
+func runRound(configuration *Configuration, n int, duration time.Duration) map[int]*Result {
+	resetCounters()
+	resultsMu.Lock()
+	results = make(map[int]*Result)
+	startTime = time.Now()
+	resultsMu.Unlock()
+	clients = n
+	startRecorders()
+	if duration > 0 {
+		runCtx, stopRun = context.WithTimeout(rootCtx, duration)
+	} else {
+		runCtx, stopRun = context.WithCancel(rootCtx)
+	}
+	defer stopRun()
+
+	var done sync.WaitGroup
+	done.Add(n)
+	for i := 0; i < n; i++ {
+		result := newResult(configuration)
+		resultsMu.Lock()
+		results[i] = result
+		resultsMu.Unlock()
+		go client(configuration, result, strconv.Itoa(i), &done)
+	}
+	done.Wait()
+
+	return results
+}
+
+// runSteps runs each of the -steps one after another with fresh counters,
+// printing a summary per step and a table of all steps at the end
+func runSteps(configuration *Configuration) {
+	f, err := os.Create("delay.txt")
+	if err != nil {
+		fmt.Println("open file failed")
+		panic(err)
+	}
+	defer f.Close()
+
+	var summaries []*Summary
+
+	for i, step := range configuration.steps {
+		if rootCtx.Err() != nil {
+			break
+		}
+
+		fmt.Printf("Step %d: dispatching %d clients for %s\n", i+1, step.clients, step.duration)
+
+		results := runRound(configuration, step.clients, step.duration)
+		writeDelays(f, results)
+		summary := summarize(results, startTime)
+		summaries = append(summaries, summary)
+		printSummary(summary)
+		fmt.Println()
+	}
+
+	unit := summaryTimeUnit()
+	fmt.Printf("%-6s %8s %10s %10s %10s %12s %10s\n", "Step", "Clients", "Duration", "Requests", "Rate", "p99", "Errors")
+	for i, summary := range summaries {
+		step := configuration.steps[i]
+		fmt.Printf("%-6d %8d %10s %10d %10d %12s %9.2f%%\n",
+			i+1, step.clients, step.duration, summary.Requests, summary.Rate, unit.format(summary.LatencyP99), summary.ErrorRate()*100)
+	}
+
+	if summaryOutPath != "" {
+		if err := writeSummariesFile(summaryOutPath, summaries); err != nil {
+			logger.Error("writing summary failed", "path", summaryOutPath, "err", err)
+		}
+	}
+}
+
+// runRepeats runs the benchmark -repeat times with fresh counters, printing a
+// summary per run and a stable estimate across all runs at the end
+func runRepeats(configuration *Configuration) {
+	f, err := os.Create("delay.txt")
+	if err != nil {
+		fmt.Println("open file failed")
+		panic(err)
+	}
+	defer f.Close()
+
+	var duration time.Duration
+	if period != -1 {
+		duration = time.Duration(period) * time.Second
+	}
+
+	var summaries []*Summary
+
+	for i := 0; i < repeatCount; i++ {
+		if rootCtx.Err() != nil {
+			break
+		}
+
+		fmt.Printf("Run %d of %d: dispatching %d clients\n", i+1, repeatCount, clients)
+
+		results := runRound(configuration, clients, duration)
+		writeDelays(f, results)
+		summary := summarize(results, startTime)
+		summaries = append(summaries, summary)
+		printSummary(summary)
+		fmt.Println()
+	}
+
+	printStableEstimate(summaries)
+
+	if summaryOutPath != "" {
+		if err := writeSummariesFile(summaryOutPath, summaries); err != nil {
+			logger.Error("writing summary failed", "path", summaryOutPath, "err", err)
+		}
+	}
+}
+
+// workerJob is what a -workers coordinator sends a -worker: the shared
+// -worker-token and the flags of the worker's share of the run, in the
+// format of -config
+type workerJob struct {
+	Token string                 `json:"token"`
+	Flags map[string]interface{} `json:"flags"`
+}
+
+// workerReport is what a -worker sends back once its share of the run is
+// over, or why it could not run it. The summary carries all the latencies
+// of the run.
+type workerReport struct {
+	Summary *Summary `json:"summary,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// workerDialTimeout bounds connecting to a -worker, not the run itself
+const workerDialTimeout = 10 * time.Second
+
+// workerReportMargin is how long past the -t or -max-duration of its job a
+// worker has to start, drain and send its report
+const workerReportMargin = 30 * time.Second
+
+// workerIOTimeout bounds a worker reading a job and sending its report, a
+// coordinator that stalls would hold up the runs of the others
+const workerIOTimeout = 30 * time.Second
+
+// maxWorkerJob is the largest job a worker reads, in bytes
+const maxWorkerJob = 1 << 20
+
+// workerJobFlags are the flags a worker runs jobs with. Anyone holding the
+// token can send jobs, so flags naming files of the worker, to read or to
+// write, are left out, as are those sending its environment elsewhere.
+var workerJobFlags = map[string]bool{
+	"r": true, "n": true, "c": true, "u": true, "k": true, "t": true,
+	"tw": true, "tr": true, "auth": true, "agent": true, "accept": true,
+	"random": true, "insecure": true, "ct": true, "s": true,
+	"min-tls": true, "max-tls": true, "sni": true, "host": true,
+	"rate": true, "arrival": true, "chunked": true, "expect-continue": true,
+	"grpc": true, "grpc-method": true, "ws": true, "ws-message": true,
+	"ws-count": true, "ws-interval": true, "keepalive-requests": true,
+	"max-response-size": true, "read-buffer": true, "discard-body": true,
+	"warmup-requests": true, "cache-bust": true, "content-length": true,
+	"url-template": true, "max-duration": true, "hosts": true,
+	"host-select": true, "conns-per-host": true, "ipv": true,
+	"honor-retry-after": true, "max-retry-after": true, "dns-timeout": true,
+	"backend": true, "phases": true, "max-memory": true, "force-body": true,
+	"tcp-keepalive": true, "expect-body-regex": true, "think": true,
+	"think-dist": true, "think-min": true, "think-max": true,
+	"think-stddev": true, "normalize-urls": true, "rate-start": true,
+	"rate-end": true, "ramp-max-errors": true, "error-backoff": true,
+	"rate-basis": true, "fail-fast-connect": true, "get-body": true,
+	"clip-percentile": true, "warn-slow": true, "runtime-stats": true,
+	"proxy": true, "first-byte-timeout": true,
+	"report-connections-reused": true, "seed": true, "client-rate": true,
+	"timeout": true, "expect-sha256": true, "rps-target": true,
+	"max-samples": true, "fail-on-network-errors": true,
+	"keep-errors-sample": true, "max-body-print": true,
+	"multipart-stream": true, "report-errors-by-url": true,
+	"idempotency-header": true, "connections-summary": true,
+	"local-addr": true, "no-latency": true, "graceful-drain": true,
+	"drain-timeout": true, "conn-strategy": true,
+	"min-expected-latency": true, "gzip": true, "stop-on-status": true,
+	"capture-header": true, "extract": true, "random-header": true,
+}
+
+// workerListenAddr is addr with localhost for a missing host, a worker
+// listens on other interfaces only when told to
+func workerListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// runWorker serves -workers coordinators on addr, one run at a time, until
+// gobench is stopped
+func runWorker(addr string) {
+	ln, err := net.Listen("tcp", workerListenAddr(addr))
+	if err != nil {
+		log.Fatalf("Error listening for coordinators: %s Error: %s", addr, err)
+	}
+	logger.Info("worker waiting for runs", "addr", ln.Addr().String())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Error("accepting a coordinator", "err", err)
+			continue
+		}
+		serveWorkerJob(conn)
+	}
+}
+
+// serveWorkerJob runs the job a coordinator sent on conn and sends it back
+// the report
+func serveWorkerJob(conn net.Conn) {
+	defer conn.Close()
+
+	var job workerJob
+	conn.SetReadDeadline(time.Now().Add(workerIOTimeout))
+	if err := json.NewDecoder(io.LimitReader(conn, maxWorkerJob)).Decode(&job); err != nil {
+		logger.Warn("reading a run", "from", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	var report workerReport
+	if subtle.ConstantTimeCompare([]byte(job.Token), []byte(workerToken)) != 1 {
+		logger.Warn("refusing a run with a wrong -worker-token", "from", conn.RemoteAddr().String())
+		report = workerReport{Error: "wrong -worker-token"}
+	} else {
+		logger.Info("running", "from", conn.RemoteAddr().String(), "clients", job.Flags["c"])
+		report = runWorkerJob(job)
+		if report.Error != "" {
+			logger.Error("run failed", "err", report.Error)
+		}
+	}
+	conn.SetWriteDeadline(time.Now().Add(workerIOTimeout))
+	if err := json.NewEncoder(conn).Encode(report); err != nil {
+		logger.Warn("sending the results", "to", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// runWorkerJob runs job as a gobench of its own, so that every run starts
+// afresh, in a scratch directory that also takes its config, summary and
+// delay.txt
+func runWorkerJob(job workerJob) workerReport {
+	for name := range job.Flags {
+		if !workerJobFlags[name] {
+			return workerReport{Error: fmt.Sprintf("-%s is not allowed on a worker", name)}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "gobench-worker-")
+	if err != nil {
+		return workerReport{Error: err.Error()}
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := json.Marshal(job.Flags)
+	if err != nil {
+		return workerReport{Error: err.Error()}
+	}
+	configFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configFile, config, 0644); err != nil {
+		return workerReport{Error: err.Error()}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return workerReport{Error: err.Error()}
+	}
+	summaryFile := filepath.Join(dir, "summary.json")
+	cmd := exec.Command(exe, "-config", configFile, "-summary-out", summaryFile, "-summary-latencies")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	// a failing gate such as -fail-on-network-errors still leaves a summary
+	runErr := cmd.Run()
+
+	summary, err := loadSummary(summaryFile)
+	if err != nil {
+		if runErr != nil {
+			return workerReport{Error: runErr.Error()}
+		}
+		return workerReport{Error: err.Error()}
+	}
+	return workerReport{Summary: summary}
 }
 
-func (this *MyConn) Read(b []byte) (n int, err error) {
-	len, err := this.Conn.Read(b)
+// workerFlags are the flags of the coordinator that its workers don't run
+// with: the coordinator's own and those of its output, which it writes itself
+var workerFlags = map[string]bool{
+	"worker":            true,
+	"workers":           true,
+	"worker-token":      true,
+	"config":            true,
+	"save-config":       true,
+	"summary-out":       true,
+	"summary-latencies": true,
+	"json":              true,
+	"format":            true,
+	"baseline":          true,
+	"latency-unit":      true,
+	"output-template":   true,
+	"v":                 true,
+	"log-level":         true,
+	"influx":            true,
+	"influx-url":        true,
+	"influx-interval":   true,
+	"label":             true,
+	"sample-rate":       true,
+	"precision":         true,
+}
 
-	if err == nil {
-		atomic.AddInt64(&readThroughput, int64(len))
+// shareRun returns the flags of worker i of n: the clients, the -n budget
+// and the rates of the run are split between the workers, the rest of the
+// flags are the coordinator's
+func shareRun(values map[string]interface{}, i int, n int) map[string]interface{} {
+	share := func(total int64) int64 {
+		part := total / int64(n)
+		if int64(i) < total%int64(n) {
+			part++
+		}
+		return part
 	}
 
-	return len, err
+	flags := make(map[string]interface{})
+	for name, value := range values {
+		if !workerFlags[name] {
+			flags[name] = value
+		}
+	}
+	flags["c"] = strconv.FormatInt(share(int64(clients)), 10)
+	if totalRequests != -1 {
+		flags["n"] = strconv.FormatInt(share(totalRequests), 10)
+	}
+	if rate > 0 {
+		flags["rate"] = strconv.FormatFloat(rate/float64(n), 'f', -1, 64)
+	}
+	if rpsTarget > 0 {
+		flags["rps-target"] = strconv.FormatFloat(rpsTarget/float64(n), 'f', -1, 64)
+	}
+	return flags
 }
 
-func (this *MyConn) Write(b []byte) (n int, err error) {
-	len, err := this.Conn.Write(b)
+// sendWorkerJob runs job on the worker at addr and waits for its report
+func sendWorkerJob(addr string, job workerJob) workerReport {
+	conn, err := net.DialTimeout("tcp", addr, workerDialTimeout)
+	if err != nil {
+		return workerReport{Error: err.Error()}
+	}
+	defer conn.Close()
 
-	if err == nil {
-		atomic.AddInt64(&writeThroughput, int64(len))
+	job.Token = workerToken
+	if err := json.NewEncoder(conn).Encode(job); err != nil {
+		return workerReport{Error: err.Error()}
 	}
 
-	return len, err
+	if limit := runLimit(); limit > 0 {
+		conn.SetReadDeadline(time.Now().Add(limit + workerReportMargin))
+	}
+	var report workerReport
+	if err := json.NewDecoder(conn).Decode(&report); err != nil {
+		return workerReport{Error: err.Error()}
+	}
+	return report
 }
 
-func init() {
-	flag.Int64Var(&requests, "r", -1, "Number of requests per client")
-	flag.IntVar(&clients, "c", 100, "Number of concurrent clients")
-	flag.StringVar(&url, "u", "", "URL")
-	flag.StringVar(&urlsFilePath, "f", "", "URL's file path (line seperated)")
-	flag.BoolVar(&keepAlive, "k", true, "Do HTTP keep-alive")
-	flag.StringVar(&postDataFilePath, "d", "", "HTTP POST data file path")
-	flag.Int64Var(&period, "t", -1, "Period of time (in seconds)")
-	flag.IntVar(&writeTimeout, "tw", 5000, "Write timeout (in milliseconds)")
-	flag.IntVar(&readTimeout, "tr", 5000, "Read timeout (in milliseconds)")
-	flag.StringVar(&authHeader, "auth", "", "Authorization header")
-	flag.StringVar(&userAgent, "agent", "", "User-Agent header")
-	flag.StringVar(&acceptEnc, "accept", "", "Accept-Encoding header")
-	flag.BoolVar(&randomize, "random", false, "Randomize URL order")
-	flag.BoolVar(&insecure, "insecure", false, "Skip verifing SSL certificate")
-	flag.BoolVar(&verbose, "v", false, "Show debug messages")
-	flag.StringVar(&contentType, "ct", "", "Content type")
-	flag.BoolVar(&uriSubstitution, "s", false, "Support <UUID> & <CID> substition in uri")
+// runLimit returns how long the run may last by -t and -max-duration, 0 if
+// neither bounds it
+func runLimit() time.Duration {
+	var limit time.Duration
+	if period > 0 {
+		limit = time.Duration(period) * time.Second
+	}
+	if maxDuration > 0 && (limit == 0 || maxDuration < limit) {
+		limit = maxDuration
+	}
+	return limit
 }
 
-func printResults(results map[int]*Result, startTime time.Time) {
-	var requests int64
-	var success int64
-	var networkFailed int64
-	var badFailed int64
+// runDistributed shares the run out to the -workers, which all start at
+// once, and prints the merged summary of their results. Percentiles are
+// those of all the latencies of the workers together, not an average of
+// theirs.
+func runDistributed() {
+	addrs := strings.Split(workersList, ",")
+	values := flagValues()
+
+	reports := make([]workerReport, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			reports[i] = sendWorkerJob(addr, workerJob{Flags: shareRun(values, i, len(addrs))})
+		}(i, strings.TrimSpace(addr))
+	}
+	logger.Info("waiting for workers", "workers", len(addrs))
+	wg.Wait()
+
+	var parts []*Summary
+	var rtts []float64
+	for i, report := range reports {
+		if report.Error != "" || report.Summary == nil {
+			logger.Error("worker failed, leaving it out", "worker", addrs[i], "err", report.Error)
+			continue
+		}
+		logger.Info("worker done", "worker", addrs[i], "requests", report.Summary.Requests)
+		parts = append(parts, report.Summary)
+		rtts = append(rtts, report.Summary.Latencies...)
+	}
+	if len(parts) == 0 {
+		log.Fatalf("Error in distributed run: no worker returned results")
+	}
+
+	// the workers sent all their latencies, the percentiles can be exact
+	sort.Float64s(rtts)
+	summary := mergeSummaries(parts)
+	setLatencies(summary, rtts)
+	if summaryLatencies {
+		summary.Latencies = rtts
+	}
 
 	f, err := os.Create("delay.txt")
 	if err != nil {
@@ -130,247 +7174,291 @@ func printResults(results map[int]*Result, startTime time.Time) {
 		panic(err)
 	}
 	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, rtt := range rtts {
+		fmt.Fprintf(w, "%f\n", rtt)
+	}
+	w.Flush()
 
-	for _, result := range results {
-		requests += result.requests
-		success += result.success
-		networkFailed += result.networkFailed
-		badFailed += result.badFailed
-		for _, rtt := range result.elapse {
-			fmt.Fprintf(f, "%f\n", rtt)
+	if summaryOutPath != "" {
+		if err := writeSummaryFile(summaryOutPath, summary); err != nil {
+			logger.Error("writing summary failed", "path", summaryOutPath, "err", err)
 		}
 	}
-
-	elapsed := int64(time.Since(startTime).Seconds())
-
-	if elapsed == 0 {
-		elapsed = 1
+	if influx != nil {
+		if err := influx.finish(summary); err != nil {
+			logger.Error("writing influx points failed", "err", err)
+		}
 	}
 
-	fmt.Println()
-	fmt.Printf("Requests:                       %10d hits\n", requests)
-	fmt.Printf("Successful requests:            %10d hits\n", success)
-	fmt.Printf("Network failed:                 %10d hits\n", networkFailed)
-	fmt.Printf("Bad requests failed (!2xx):     %10d hits\n", badFailed)
-	fmt.Printf("Successful requests rate:       %10d hits/sec\n", success/elapsed)
-	fmt.Printf("Read throughput:                %10d bytes/sec\n", readThroughput/elapsed)
-	fmt.Printf("Write throughput:               %10d bytes/sec\n", writeThroughput/elapsed)
-	fmt.Printf("Test time:                      %10d sec\n", elapsed)
-	fmt.Printf("Average request latency:              %4.2f msec\n", float64(elapsed)/float64(success)*1000)
+	printFinalSummary(summary)
+	checkNetworkErrors(summary)
 }
 
-func readLines(path string) (lines []string, err error) {
+// maxProbes bounds the number of probing runs of -find-max-throughput
+const maxProbes = 10
 
-	var file *os.File
-	var part []byte
-	var prefix bool
-
-	if file, err = os.Open(path); err != nil {
-		return
-	}
-	defer file.Close()
+// findMaxThroughput binary-searches the rate between 0 and -rate for the
+// highest one at which p99 stays under -target-p99. A probe passes when its
+// p99 meets the target and the clients kept up with at least 90% of the
+// offered rate, otherwise latency is hidden by requests that were never sent.
+func findMaxThroughput(configuration *Configuration) {
+	low, high := 0.0, configuration.rate
+	sustainable := 0.0
 
-	reader := bufio.NewReader(file)
-	buffer := bytes.NewBuffer(make([]byte, 0))
-	for {
-		if part, prefix, err = reader.ReadLine(); err != nil {
-			break
+	for probe := 1; probe <= maxProbes && rootCtx.Err() == nil; probe++ {
+		// probe the upper bound first, it may be sustainable already
+		offered := high
+		if probe > 1 {
+			offered = (low + high) / 2
 		}
-		buffer.Write(part)
-		if !prefix {
-			lines = append(lines, buffer.String())
-			buffer.Reset()
+		configuration.rate = offered
+
+		results := runRound(configuration, clients, probeDuration)
+		summary := summarize(results, startTime)
+		achieved := float64(summary.Requests) / probeDuration.Seconds()
+		p99 := time.Duration(summary.LatencyP99 * float64(time.Second))
+
+		ok := p99 <= targetP99 && achieved >= 0.9*offered
+		verdict := "over target"
+		if ok {
+			verdict = "ok"
 		}
-	}
-	if err == io.EOF {
-		err = nil
-	}
-	return
-}
+		fmt.Printf("Probe %d: offered %.0f req/sec, achieved %.0f req/sec, p99 %s (%s)\n",
+			probe, offered, achieved, p99, verdict)
 
-func NewConfiguration() *Configuration {
+		if ok {
+			sustainable = offered
+			low = offered
+			if probe == 1 {
+				break
+			}
+		} else {
+			high = offered
+		}
 
-	if urlsFilePath == "" && url == "" {
-		flag.Usage()
-		os.Exit(1)
+		// stop once the bounds are within 2% of each other
+		if high-low <= high*0.02 {
+			break
+		}
 	}
 
-	if requests == -1 && period == -1 {
-		fmt.Println("Requests or period must be provided")
-		flag.Usage()
-		os.Exit(1)
+	fmt.Println()
+	if sustainable == 0 {
+		fmt.Printf("No probed rate kept p99 under %s\n", targetP99)
+		return
 	}
+	fmt.Printf("Sustainable rate:               %10.0f req/sec (p99 under %s)\n", sustainable, targetP99)
+}
 
-	if requests != -1 && period != -1 {
-		fmt.Println("Only one should be provided: [requests|period]")
-		flag.Usage()
-		os.Exit(1)
-	}
+// maxConcurrencyProbes bounds the number of probing runs of
+// -auto-concurrency, doubling up to -c takes up to log2(c) of them
+const maxConcurrencyProbes = 20
 
-	configuration := &Configuration{
-		urls:            make([]string, 0),
-		method:          "GET",
-		postData:        nil,
-		keepAlive:       keepAlive,
-		requests:        int64((1 << 63) - 1),
-		authHeader:      authHeader,
-		acceptEnc:       acceptEnc,
-		randomize:       randomize,
-		uriSubstitution: uriSubstitution,
-		contentType:     contentType}
+// findMaxConcurrency is the closed model counterpart of findMaxThroughput:
+// it searches the client count between 1 and -c for the highest one at
+// which p99 stays under -target-p99, doubling the clients until a probe
+// fails and then bisecting between the last passing and the failing count.
+func findMaxConcurrency(configuration *Configuration) {
+	maxClients := clients
+	sustainable, failing := 0, maxClients+1
 
-	if period != -1 {
-		configuration.period = period
+	n := 1
+	for probe := 1; probe <= maxConcurrencyProbes && rootCtx.Err() == nil; probe++ {
+		results := runRound(configuration, n, probeDuration)
+		summary := summarize(results, startTime)
+		p99 := time.Duration(summary.LatencyP99 * float64(time.Second))
 
-		timeout := make(chan bool, 1)
-		go func() {
-			<-time.After(time.Duration(period) * time.Second)
-			timeout <- true
-		}()
+		ok := summary.Success > 0 && p99 <= targetP99
+		verdict := "over target"
+		if ok {
+			verdict = "ok"
+		}
+		fmt.Printf("Probe %d: %d clients, %d req/sec, p99 %s (%s)\n",
+			probe, n, summary.Rate, p99, verdict)
 
-		go func() {
-			<-timeout
-			if runtime.GOOS == "windows" {
-				printResults(results, startTime)
-				os.Exit(0)
-			}
-			pid := os.Getpid()
-			proc, _ := os.FindProcess(pid)
-			err := proc.Signal(os.Interrupt)
-			if err != nil {
-				log.Println(err)
-				fmt.Println(err)
-				return
+		if ok {
+			sustainable = n
+		} else {
+			failing = n
+		}
+
+		next := (sustainable + failing) / 2
+		if failing > maxClients {
+			next = n * 2
+			if next > maxClients {
+				next = maxClients
 			}
-		}()
+		}
+		if next <= sustainable || next >= failing {
+			break
+		}
+		n = next
 	}
 
-	if requests != -1 {
-		configuration.requests = requests
+	fmt.Println()
+	if sustainable == 0 {
+		fmt.Printf("No probed client count kept p99 under %s\n", targetP99)
+		return
 	}
+	fmt.Printf("Sustainable concurrency:        %10d clients (p99 under %s)\n", sustainable, targetP99)
+}
 
-	if urlsFilePath != "" {
-		fileLines, err := readLines(urlsFilePath)
+// spread returns the median, minimum and maximum of values
+func spread(values []float64) (median, min, max float64) {
+	if len(values) == 0 {
+		return 0, 0, 0
+	}
 
-		if err != nil {
-			log.Fatalf("Error in ioutil.ReadFile for file: %s Error: %s", urlsFilePath, err)
-		}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
 
-		configuration.urls = fileLines
+	n := len(sorted)
+	median = sorted[n/2]
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
 	}
+	return median, sorted[0], sorted[n-1]
+}
 
-	if url != "" {
-		configuration.urls = append(configuration.urls, url)
+// printStableEstimate prints the median and range of the headline metrics
+// over repeated runs, which is less noisy than any single run
+func printStableEstimate(summaries []*Summary) {
+	var rates, p99s, errorRates []float64
+	for _, summary := range summaries {
+		rates = append(rates, float64(summary.Rate))
+		p99s = append(p99s, summary.LatencyP99)
+		errorRates = append(errorRates, summary.ErrorRate()*100)
 	}
 
-	if postDataFilePath != "" {
-		configuration.method = "POST"
+	fmt.Printf("Stable estimate over %d runs:   %10s %10s %10s\n", len(summaries), "median", "min", "max")
 
-		data, err := ioutil.ReadFile(postDataFilePath)
+	median, min, max := spread(rates)
+	fmt.Printf("%-32s%10.0f %10.0f %10.0f hits/sec\n", rateLabel(), median, min, max)
 
-		if err != nil {
-			log.Fatalf("Error in ioutil.ReadFile for file path: %s Error:%s", postDataFilePath, err)
-		}
+	unit := summaryTimeUnit()
+	median, min, max = spread(p99s)
+	fmt.Printf("Request latency p99:            %10s %10s %10s\n", unit.format(median), unit.format(min), unit.format(max))
 
-		configuration.postData = data
-	}
+	median, min, max = spread(errorRates)
+	fmt.Printf("Error rate:                     %9.2f%% %9.2f%% %9.2f%%\n", median, min, max)
+}
 
-	configuration.myClient.ReadTimeout = time.Duration(readTimeout) * time.Millisecond
-	configuration.myClient.WriteTimeout = time.Duration(writeTimeout) * time.Millisecond
-	configuration.myClient.MaxConnsPerHost = clients
-	configuration.myClient.Name = userAgent
-	configuration.myClient.TLSConfig = &tls.Config{InsecureSkipVerify: insecure}
+var results map[int]*Result = make(map[int]*Result)
 
-	configuration.myClient.Dial = MyDialer()
+// resultsMu guards results and startTime while the clients are dispatched,
+// for -snapshot-on-signal
+var resultsMu sync.Mutex
 
-	return configuration
-}
+// logLevel is the -log-level of logger
+var logLevel = new(slog.LevelVar)
 
-func MyDialer() func(address string) (conn net.Conn, err error) {
-	return func(address string) (net.Conn, error) {
-		conn, err := net.Dial("tcp", address)
-		if err != nil {
-			return nil, err
+// logger logs the diagnostics of a run (failed requests, warnings and with
+// -v every response) to stderr, stdout only gets the results
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// snapshotOnSignal prints a summary of the results so far on every one of
+// snapshotSignals, while the clients keep running. The numbers are only
+// approximate, the clients don't stop updating them to be read.
+func snapshotOnSignal() {
+	if len(snapshotSignals) == 0 {
+		logger.Warn("snapshots on signal (-snapshot-on-signal) are not supported on this platform")
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, snapshotSignals...)
+	for range signals {
+		resultsMu.Lock()
+		snapshot := make(map[int]*Result, len(results))
+		for id, result := range results {
+			snapshot[id] = result
 		}
+		start := startTime
+		resultsMu.Unlock()
 
-		myConn := &MyConn{Conn: conn}
+		// each client pauses once done with the request it is recording
+		for _, result := range snapshot {
+			result.recordMu.Lock()
+		}
+		summary := summarize(snapshot, start)
+		for _, result := range snapshot {
+			result.recordMu.Unlock()
+		}
 
-		return myConn, nil
+		fmt.Printf("\nSnapshot after %s:\n", time.Since(start).Round(time.Second))
+		printSummary(summary)
+		fmt.Println()
 	}
 }
 
-func uriReplacer(s string, id string) string {
-	r := strings.NewReplacer("<UUID>", uuid.New(), "<CID>", id)
-	return r.Replace(s)
-}
-
-func client(configuration *Configuration, result *Result, id string, done *sync.WaitGroup) {
-	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	for result.requests < configuration.requests {
-		var tmpUrls []string
-		if configuration.randomize {
-			tmpUrls = []string{configuration.urls[rand.Intn(len(configuration.urls))]}
-		} else {
-			tmpUrls = configuration.urls
-		}
-		for _, tmpUrl := range tmpUrls {
+var startTime time.Time
 
-			req := fasthttp.AcquireRequest()
+// printOnce prints the results of the run, be it at its end or on an
+// interrupt
+var printOnce sync.Once
 
-			req_start := time.Now()
-			if configuration.uriSubstitution {
-				req.SetRequestURI(uriReplacer(tmpUrl, id))
-			} else {
-				req.SetRequestURI(tmpUrl)
-			}
-			req.Header.SetMethodBytes([]byte(configuration.method))
+// clients running their requests, and those -graceful-drain stopped
+// waiting for
+var runningClients int64
+var drainCancelled int64
 
-			if len(configuration.acceptEnc) > 0 {
-				req.Header.Set("Accept-Encoding", configuration.acceptEnc)
-			}
+// drain stops the run and waits up to -drain-timeout for the clients to
+// finish and record their requests in flight. The request of each client
+// still busy past the timeout is counted as cancelled. Another signal on
+// signals cuts the wait short.
+func drain(signals <-chan os.Signal) {
+	abortRun()
+	logger.Info("draining the requests in flight", "clients", atomic.LoadInt64(&runningClients), "timeout", drainTimeout)
 
-			if len(configuration.contentType) > 0 {
-				req.Header.Set("Content-Type", configuration.contentType)
-			}
-			req.SetBody(configuration.postData)
+	timeout := time.NewTimer(drainTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
 
-			resp := fasthttp.AcquireResponse()
-			requestTimer := time.Now().UTC()
-			err := configuration.myClient.Do(req, resp)
-			if err != nil {
-				fmt.Printf("%s\n", err)
-			}
-			statusCode := resp.StatusCode()
-			if verbose {
-				fmt.Printf("Got status code [%d] - Request took [%s]\n", statusCode, time.Since(requestTimer))
-			}
-			result.requests++
-			if err != nil {
-				fmt.Printf("Network error: %s\n", err)
-				result.networkFailed++
-				continue
-			}
-			if resp.StatusCode() != fasthttp.StatusOK {
-				result.badFailed++
-			} else {
-				if verbose {
-					fmt.Printf("Non-2xx Status Code returned: [%d]\n", statusCode)
-				}
-				result.success++
-			}
-			result.elapse = append(result.elapse, time.Since(req_start).Seconds())
+	for atomic.LoadInt64(&runningClients) > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			atomic.StoreInt64(&drainCancelled, atomic.LoadInt64(&runningClients))
+			return
+		case <-signals:
+			atomic.StoreInt64(&drainCancelled, atomic.LoadInt64(&runningClients))
+			return
 		}
 	}
-
-	done.Done()
 }
 
-var results map[int]*Result = make(map[int]*Result)
+func main() {
 
-var startTime time.Time
+	// gobench compare old.txt new.txt, before the flags of a run
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		flag.CommandLine.Parse(os.Args[2:])
+		if flag.NArg() != 2 {
+			fmt.Println("Usage: gobench compare [-precision n] <old delay.txt> <new delay.txt>")
+			os.Exit(1)
+		}
+		if err := compareDelays(flag.Arg(0), flag.Arg(1)); err != nil {
+			log.Fatalf("Error comparing delays: %s", err)
+		}
+		return
+	}
 
-func main() {
+	// gobench merge a.json b.json..., summaries of runs side by side
+	if len(os.Args) > 1 && os.Args[1] == "merge" {
+		flag.CommandLine.Parse(os.Args[2:])
+		if flag.NArg() < 1 {
+			fmt.Println("Usage: gobench merge [-format text|json|csv|prometheus] [-summary-out file] <summary.json>...")
+			os.Exit(1)
+		}
+		if err := checkFormat(); err != nil {
+			log.Fatalf("Error merging summaries: %s", err)
+		}
+		if err := mergeSummaryFiles(flag.Args()); err != nil {
+			log.Fatalf("Error merging summaries: %s", err)
+		}
+		return
+	}
 
 	startTime = time.Now()
 	var done sync.WaitGroup
@@ -378,34 +7466,113 @@ func main() {
 	signal.Notify(signalChannel, os.Interrupt)
 	go func() {
 		_ = <-signalChannel
-		fmt.Println("in coroutine print results")
-		printResults(results, startTime)
-		fmt.Println("in coroutine print results done")
+		if gracefulDrain {
+			drain(signalChannel)
+		}
+		logger.Debug("interrupted, printing results")
+		// the clients still running stop at their next request, for good
+		resultsMu.Lock()
+		for _, result := range results {
+			result.recordMu.Lock()
+		}
+		printOnce.Do(func() { printResults(results, startTime) })
 		os.Exit(0)
 	}()
 
 	flag.Parse()
 
+	if workerToken == "" {
+		workerToken = os.Getenv("GOBENCH_WORKER_TOKEN")
+	}
+
+	if workerAddr != "" {
+		if workerToken == "" {
+			fmt.Println("A worker (-worker) needs a -worker-token shared with its coordinators")
+			flag.Usage()
+			os.Exit(1)
+		}
+		runWorker(workerAddr)
+		return
+	}
+
+	if configPath != "" {
+		if err := loadConfigFile(configPath); err != nil {
+			log.Fatalf("Error loading config file: %s Error: %s", configPath, err)
+		}
+	}
+
+	if saveConfigPath != "" {
+		if err := saveConfigFile(saveConfigPath); err != nil {
+			log.Fatalf("Error saving config file: %s Error: %s", saveConfigPath, err)
+		}
+	}
+
 	configuration := NewConfiguration()
 
+	go sampleConnections()
+
+	if snapshotSignal {
+		go snapshotOnSignal()
+	}
+
 	goMaxProcs := os.Getenv("GOMAXPROCS")
 
 	if goMaxProcs == "" {
 		runtime.GOMAXPROCS(runtime.NumCPU())
 	}
 
-	fmt.Printf("Dispatching %d clients\n", clients)
+	if configuration.check {
+		runCheck(configuration)
+		return
+	}
+
+	if workersList != "" {
+		runDistributed()
+		return
+	}
+
+	if len(configuration.steps) > 0 {
+		runSteps(configuration)
+		return
+	}
+
+	if repeatCount > 1 {
+		runRepeats(configuration)
+		return
+	}
+
+	if findMaxRate {
+		findMaxThroughput(configuration)
+		return
+	}
+
+	if autoConcurrency {
+		findMaxConcurrency(configuration)
+		return
+	}
+
+	if configuration.rpsTarget > 0 {
+		// start with one client, the controller takes it from there
+		atomic.StoreInt64(&activeClients, 1)
+		go holdTargetRate(configuration)
+	}
+
+	logger.Info("dispatching clients", "clients", clients)
 
+	startRecorders()
 	done.Add(clients)
 	for i := 0; i < clients; i++ {
-		result := &Result{}
+		result := newResult(configuration)
+		resultsMu.Lock()
 		results[i] = result
+		resultsMu.Unlock()
 		go client(configuration, result, strconv.Itoa(i), &done)
 
 	}
-	fmt.Println("Waiting for results...")
+	logger.Info("waiting for results")
 
 	done.Wait()
-	fmt.Println("wait is done")
-	printResults(results, startTime)
+	logger.Debug("all clients done")
+	// a drained interrupt may be printing the results already
+	printOnce.Do(func() { printResults(results, startTime) })
 }
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// connReader hides the WriterTo of a bytes.Reader, which io.Copy would
+// use to skip the copying a connection goes through
+type connReader struct {
+	io.Reader
+}
+
+// BenchmarkDiscardBody compares draining a streamed 1 MB response body
+// through a reused buffer, as -discard-body does, with reading it whole
+func BenchmarkDiscardBody(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+
+	b.Run("discard", func(b *testing.B) {
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(resp)
+		buf := make([]byte, 32*1024)
+
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			resp.SetBodyStream(connReader{bytes.NewReader(payload)}, len(payload))
+			if err := discardResponseBody(resp, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("read", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadAll(connReader{bytes.NewReader(payload)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestClaimRequestStopsAtTheBudget(t *testing.T) {
+	atomic.StoreInt64(&issuedRequests, 0)
+	defer atomic.StoreInt64(&issuedRequests, 0)
+
+	const clientCount, budget = 8, 2000
+	configuration := &Configuration{totalRequests: budget}
+	counts := make([]int64, clientCount)
+
+	var wg sync.WaitGroup
+	for i := 0; i < clientCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for claimRequest(configuration) {
+				counts[i]++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total != budget {
+		t.Fatalf("claimed %d requests, want %d: %v", total, budget, counts)
+	}
+	for i := 0; i < clientCount; i++ {
+		if claimRequest(configuration) {
+			t.Fatal("claimed a request after the budget ran out")
+		}
+	}
+}
+
+func TestRecordLatencyCountsDroppedSamples(t *testing.T) {
+	defer atomic.StoreInt32(&samplesCapped, 0)
+
+	result := &Result{}
+	r := rand.New(rand.NewSource(1))
+	for i := 1; i <= 1000; i++ {
+		if i == 100 {
+			// the heap went over -max-memory
+			atomic.StoreInt32(&samplesCapped, 1)
+		}
+		recordLatency(result, time.Duration(i)*time.Millisecond, r)
+	}
+	if len(result.elapse) != 99 || result.samplesDropped != 901 {
+		t.Errorf("kept %d samples and dropped %d, want 99 and 901", len(result.elapse), result.samplesDropped)
+	}
+}
+
+func TestGETRequestsCarryNoBodyByDefault(t *testing.T) {
+	body := []byte(`{"id": 1}`)
+	tests := []struct {
+		name          string
+		configuration *Configuration
+	}{
+		{"plain", &Configuration{contentLength: -1}},
+		{"chunked", &Configuration{contentLength: -1, chunked: true}},
+		{"content-length", &Configuration{contentLength: 4}},
+		{"multipart-stream", &Configuration{contentLength: -1, multipartSize: 1024}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+
+			setRequestBody(test.configuration, req, "GET", body)
+			if req.IsBodyStream() || len(req.Body()) > 0 {
+				t.Errorf("GET carries a body: %q", req.Body())
+			}
+
+			req = fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+
+			setRequestBody(test.configuration, req, "POST", body)
+			if len(req.Body()) == 0 {
+				t.Errorf("POST carries no body")
+			}
+		})
+	}
+}
+
+func TestGETBodyWithForceBody(t *testing.T) {
+	for _, configuration := range []*Configuration{
+		{contentLength: -1, forceBody: true},
+		{contentLength: -1, getBody: true},
+	} {
+		req := fasthttp.AcquireRequest()
+		setRequestBody(configuration, req, "GET", []byte("q"))
+		if string(req.Body()) != "q" {
+			t.Errorf("GET body = %q, want %q", req.Body(), "q")
+		}
+		fasthttp.ReleaseRequest(req)
+	}
+}
+
+func TestLoadSchemaRejectsUnsupportedKeywords(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		schema string
+		ok     bool
+	}{
+		{`{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "order", "type": "object"}`, true},
+		{`{"type": "object", "properties": {"id": {"type": "integer", "description": "order id"}}}`, true},
+		{`{"oneOf": [{"type": "string"}, {"type": "number"}]}`, false},
+		{`{"type": "object", "properties": {"tags": {"type": "array", "uniqueItems": true}}}`, false},
+		{`{"type": "object", "additionalProperties": {"type": "string"}}`, false},
+	} {
+		path := filepath.Join(dir, "schema.json")
+		if err := os.WriteFile(path, []byte(test.schema), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadSchema(path)
+		if test.ok && err != nil {
+			t.Errorf("%s: %s", test.schema, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: loaded, want an unsupported keyword error", test.schema)
+		}
+	}
+}
+
+func TestReadLinesLongLine(t *testing.T) {
+	dir := t.TempDir()
+
+	fits := filepath.Join(dir, "fits.txt")
+	long := strings.Repeat("a", maxLineLength-1)
+	if err := os.WriteFile(fits, []byte("first\n"+long+"\nlast\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := readLines(fits)
+	if err != nil {
+		t.Fatalf("line of %d bytes: %s", len(long), err)
+	}
+	if len(lines) != 3 || lines[1] != long || lines[2] != "last" {
+		t.Errorf("got %d lines, want the 3 of the file", len(lines))
+	}
+
+	tooLong := filepath.Join(dir, "too-long.txt")
+	if err := os.WriteFile(tooLong, []byte("first\n"+strings.Repeat("a", maxLineLength+1)+"\nlast\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines, err = readLines(tooLong)
+	if err == nil {
+		t.Fatalf("line over maxLineLength: got %d lines, want an error", len(lines))
+	}
+	if !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("error %q doesn't name line 2", err)
+	}
+}
+
+// failingReader returns data, then err
+type failingReader struct {
+	data *strings.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data.Len() == 0 {
+		return 0, r.err
+	}
+	return r.data.Read(p)
+}
+
+func TestScanLinesReadError(t *testing.T) {
+	broken := errors.New("disk gone")
+	lines, err := scanLines(&failingReader{data: strings.NewReader("one\ntwo\nthr"), err: broken})
+	if err == nil {
+		t.Fatalf("got %d lines, want the read error", len(lines))
+	}
+	if lines != nil {
+		t.Errorf("got lines %q with the error, want none", lines)
+	}
+	if !strings.Contains(err.Error(), broken.Error()) {
+		t.Errorf("error %q, want %q", err, broken)
+	}
+}
+
+func TestNewResultPresizeIsCappedAcrossClients(t *testing.T) {
+	savedRequests, savedClients := requests, clients
+	defer func() { requests, clients = savedRequests, savedClients }()
+
+	requests, clients = 1<<20, 1000
+	result := newResult(&Configuration{requests: requests})
+	if total := int64(cap(result.elapse)) * int64(clients); total > maxPresize {
+		t.Errorf("%d clients presize %d samples, want at most %d", clients, total, maxPresize)
+	}
+
+	requests, clients = 100, 10
+	result = newResult(&Configuration{requests: requests})
+	if cap(result.elapse) != 100 {
+		t.Errorf("presized %d samples for -r 100, want 100", cap(result.elapse))
+	}
+}
+
+// BenchmarkRecordLatency records the latencies of a -r 10000 client into a
+// Result presized by newResult and into one grown from empty, as before
+// presizing
+func BenchmarkRecordLatency(b *testing.B) {
+	const perClient = 10000
+	savedRequests, savedClients := requests, clients
+	defer func() { requests, clients = savedRequests, savedClients }()
+	clients = 100
+
+	for _, presized := range []bool{false, true} {
+		name := "grown"
+		if presized {
+			name = "presized"
+		}
+		b.Run(name, func(b *testing.B) {
+			requests = -1
+			if presized {
+				requests = perClient
+			}
+			configuration := &Configuration{requests: perClient}
+
+			r := rand.New(rand.NewSource(1))
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				result := newResult(configuration)
+				for j := 0; j < perClient; j++ {
+					recordLatency(result, time.Millisecond, r)
+				}
+			}
+		})
+	}
+}
+
+// exchangeConn is a connection that reads a response of its own after
+// every write, and fails after the given number of reads
+type exchangeConn struct {
+	net.Conn
+	reads, failAfter int
+}
+
+func (c *exchangeConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func (c *exchangeConn) Read(b []byte) (int, error) {
+	c.reads++
+	if c.reads > c.failAfter {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(b, "HTTP/1.1 200 OK\r\n\r\n"), nil
+}
+
+func TestProxyRequestsAreCountedPerRequest(t *testing.T) {
+	p := &proxy{address: "10.0.0.1:3128"}
+	conn := &MyConn{Conn: &exchangeConn{failAfter: 3}, proxy: p}
+	buf := make([]byte, 64)
+
+	for i := 0; i < 4; i++ {
+		// a request written in parts, then its response read in parts
+		conn.Write([]byte("GET / HTTP/1.1\r\n"))
+		conn.Write([]byte("Host: localhost\r\n\r\n"))
+		conn.Read(buf)
+	}
+	conn.Read(buf)
+
+	if p.stats.Requests != 4 || p.stats.RequestsFailed != 1 {
+		t.Errorf("counted %d requests, %d failed, want 4, 1 failed", p.stats.Requests, p.stats.RequestsFailed)
+	}
+}
+
+func TestCheckURLsFilteredToEmpty(t *testing.T) {
+	savedPath := urlsFilePath
+	defer func() { urlsFilePath = savedPath }()
+
+	urlsFilePath = filepath.Join(t.TempDir(), "urls.txt")
+	if err := os.WriteFile(urlsFilePath, []byte("\n   \n# staging hosts\n\t\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	urls, err := readURLs(urlsFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 0 {
+		t.Fatalf("read URLs %q from blank lines and comments, want none", urls)
+	}
+	if err := checkURLs(urls); err == nil {
+		t.Error("no error for a -f file of no URLs, -random would pick from nothing")
+	}
+
+	if err := checkURLs([]string{"http://localhost:8080/"}); err != nil {
+		t.Errorf("error %q for a URL", err)
+	}
+}
+
+func TestCumulativeWeightsAllZero(t *testing.T) {
+	urls := []string{"http://localhost/a", "http://localhost/b"}
+	if _, err := cumulativeWeights(urls, map[string]float64{urls[0]: 0, urls[1]: 0}); err == nil {
+		t.Error("no error with every URL weighted 0, pickURL would have nothing to pick")
+	}
+
+	weights, err := cumulativeWeights(urls, map[string]float64{urls[0]: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration := &Configuration{urls: urls, urlWeights: weights}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if picked := pickURL(configuration, r); picked != urls[1] {
+			t.Fatalf("picked %s, weighted 0", picked)
+		}
+	}
+}
+
+func TestReservoirFollowsTheClientRand(t *testing.T) {
+	savedClients := clients
+	defer func() { clients = savedClients }()
+	clients = 1
+
+	sample := func() []float64 {
+		r := rand.New(rand.NewSource(42))
+		result := newResult(&Configuration{maxSamples: 10})
+		for i := 1; i <= 1000; i++ {
+			recordLatency(result, time.Duration(i)*time.Millisecond, r)
+		}
+		return result.elapse
+	}
+	first, second := sample(), sample()
+	if len(first) != 10 {
+		t.Fatalf("kept %d samples, want 10", len(first))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("samples differ with the same seed: %v and %v", first, second)
+		}
+	}
+}
+
+func TestQueueWaitsAreBoundedByMaxSamples(t *testing.T) {
+	saved := maxSamples
+	defer func() {
+		maxSamples = saved
+		queueSamples, queueSeen = nil, 0
+	}()
+
+	maxSamples = 100
+	for i := 0; i < 10000; i++ {
+		recordQueueWait(time.Millisecond)
+	}
+	if len(queueSamples) != 100 || queueSeen != 10000 {
+		t.Errorf("kept %d of %d queue waits, want 100 of 10000", len(queueSamples), queueSeen)
+	}
+}
+
+func TestStreamedLatenciesCoverDroppedSamples(t *testing.T) {
+	savedMemory, savedClients := maxMemory, clients
+	defer func() {
+		maxMemory, clients = savedMemory, savedClients
+		atomic.StoreInt32(&samplesCapped, 0)
+	}()
+	maxMemory, clients = 512, 1
+
+	result := newResult(&Configuration{})
+	r := rand.New(rand.NewSource(1))
+	for i := 1; i <= 1000; i++ {
+		if i == 100 {
+			// the heap went over -max-memory
+			atomic.StoreInt32(&samplesCapped, 1)
+		}
+		recordLatency(result, time.Duration(i)*time.Millisecond, r)
+	}
+	if len(result.elapse) != 99 || result.samplesDropped != 901 {
+		t.Fatalf("kept %d samples and dropped %d, want 99 and 901", len(result.elapse), result.samplesDropped)
+	}
+
+	summary := &Summary{}
+	setStreamedLatencies(summary, map[int]*Result{0: result})
+	var counted int64
+	for _, bucket := range summary.LatencyHistogram {
+		counted += bucket.Count
+	}
+	if counted != 1000 {
+		t.Errorf("histogram counts %d latencies, want 1000", counted)
+	}
+	if summary.LatencyMax != 1 {
+		t.Errorf("max %f, want 1", summary.LatencyMax)
+	}
+	if p99 := summary.LatencyP99; math.Abs(p99-0.99)/0.99 > 0.02 {
+		t.Errorf("p99 %f, want 0.99 within 2%%", p99)
+	}
+}
+
+func TestProxyConnReadsAndWritesFromTwoGoroutines(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	p := &proxy{address: "10.0.0.1:3128"}
+	conn := &MyConn{Conn: client, proxy: p}
+
+	// net/http writes requests and reads responses in goroutines of their own
+	go io.Copy(server, server)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	}
+	conn.Close()
+	<-done
+
+	if requests := atomic.LoadInt64(&p.stats.Requests); requests == 0 {
+		t.Error("counted no requests")
+	}
+}
+
+func TestWorkerJobRoundTrip(t *testing.T) {
+	saved := workerToken
+	defer func() { workerToken = saved }()
+	workerToken = "s3cret"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serveWorkerJob(conn)
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		flags   map[string]interface{}
+		wantErr string
+	}{
+		{"file flag", map[string]interface{}{"c": "1", "d": "/etc/passwd"}, "-d is not allowed on a worker"},
+		{"output flag", map[string]interface{}{"summary-out": "out.json"}, "-summary-out is not allowed on a worker"},
+		{"coordinator flag", map[string]interface{}{"workers": "localhost:7070"}, "-workers is not allowed on a worker"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := sendWorkerJob(ln.Addr().String(), workerJob{Flags: tt.flags})
+			if report.Error != tt.wantErr {
+				t.Errorf("report error %q, want %q", report.Error, tt.wantErr)
+			}
+			if report.Summary != nil {
+				t.Error("report carries a summary of a refused run")
+			}
+		})
+	}
+
+	t.Run("wrong token", func(t *testing.T) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := json.NewEncoder(conn).Encode(workerJob{Token: "guess", Flags: map[string]interface{}{"c": "1"}}); err != nil {
+			t.Fatal(err)
+		}
+		var report workerReport
+		if err := json.NewDecoder(conn).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Error != "wrong -worker-token" {
+			t.Errorf("report error %q, want %q", report.Error, "wrong -worker-token")
+		}
+	})
+}
+
+func TestShareRunSplitsTheRun(t *testing.T) {
+	savedClients, savedRequests, savedRate := clients, totalRequests, rate
+	defer func() { clients, totalRequests, rate = savedClients, savedRequests, savedRate }()
+	clients, totalRequests, rate = 10, 101, 30
+
+	values := map[string]interface{}{"u": "http://localhost/", "c": "10", "summary-out": "out.json"}
+	tests := []struct {
+		worker      int
+		wantClients string
+		wantN       string
+	}{
+		{0, "4", "34"},
+		{1, "3", "34"},
+		{2, "3", "33"},
+	}
+	for _, tt := range tests {
+		flags := shareRun(values, tt.worker, 3)
+		if flags["c"] != tt.wantClients || flags["n"] != tt.wantN || flags["rate"] != "10" {
+			t.Errorf("worker %d runs -c %v -n %v -rate %v, want -c %s -n %s -rate 10",
+				tt.worker, flags["c"], flags["n"], flags["rate"], tt.wantClients, tt.wantN)
+		}
+		if flags["u"] != "http://localhost/" {
+			t.Errorf("worker %d runs -u %v", tt.worker, flags["u"])
+		}
+		if _, ok := flags["summary-out"]; ok {
+			t.Errorf("worker %d is sent the -summary-out of the coordinator", tt.worker)
+		}
+	}
+}
+
+func TestMergeSummariesMatchesPooledLatencies(t *testing.T) {
+	latencies := func(from, to, step float64) []float64 {
+		var rtts []float64
+		for v := from; v <= to; v += step {
+			rtts = append(rtts, v)
+		}
+		return rtts
+	}
+
+	tests := []struct {
+		name  string
+		parts [][]float64
+	}{
+		{"same spread", [][]float64{latencies(0.001, 1, 0.001), latencies(0.001, 1, 0.001)}},
+		{"fast and slow", [][]float64{latencies(0.001, 0.1, 0.0001), latencies(0.5, 2.5, 0.01)}},
+		{"one outlier part", [][]float64{latencies(0.010, 0.020, 0.00001), {3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parts []*Summary
+			var pooled []float64
+			for _, rtts := range tt.parts {
+				part := &Summary{}
+				setLatencies(part, rtts)
+				parts = append(parts, part)
+				pooled = append(pooled, rtts...)
+			}
+			sort.Float64s(pooled)
+			want := &Summary{}
+			setLatencies(want, pooled)
+
+			merged := mergeSummaries(parts)
+			for _, p := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"p50", merged.LatencyP50, want.LatencyP50},
+				{"p90", merged.LatencyP90, want.LatencyP90},
+				{"p99", merged.LatencyP99, want.LatencyP99},
+			} {
+				// the merged percentiles are bucket bounds, 2% apart
+				if math.Abs(p.got-p.want)/p.want > histogramGrowth-1 {
+					t.Errorf("%s %f, pooled %f", p.name, p.got, p.want)
+				}
+			}
+			if merged.LatencyMax != want.LatencyMax {
+				t.Errorf("max %f, pooled %f", merged.LatencyMax, want.LatencyMax)
+			}
+			if math.Abs(merged.LatencyMean-want.LatencyMean) > 1e-9 || math.Abs(merged.LatencyStddev-want.LatencyStddev) > 1e-9 {
+				t.Errorf("mean %f stddev %f, pooled %f and %f", merged.LatencyMean, merged.LatencyStddev, want.LatencyMean, want.LatencyStddev)
+			}
+		})
+	}
+}
+
+func TestMannWhitneyReferenceValues(t *testing.T) {
+	// z from U and the p-values of R's wilcox.test(a, b, exact = FALSE,
+	// correct = FALSE)
+	tests := []struct {
+		name string
+		a, b []float64
+		z, p float64
+	}{
+		{"apart", []float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10}, -2.6111648393, 0.0090234388},
+		{"ties", []float64{1, 2, 2, 3}, []float64{2, 3, 3, 4}, -1.5174424467, 0.1291550140},
+		{"interleaved", []float64{0.8, 1.1, 1.3, 2.0, 2.4, 3.1}, []float64{0.9, 1.0, 1.2, 1.5}, 1.0660035818, 0.2864220228},
+		{"all equal", []float64{1, 1, 1}, []float64{1, 1}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, p := mannWhitney(tt.a, tt.b)
+			if math.Abs(z-tt.z) > 1e-9 || math.Abs(p-tt.p) > 1e-9 {
+				t.Errorf("z %.10f p %.10f, want %.10f and %.10f", z, p, tt.z, tt.p)
+			}
+		})
+	}
+}
+
+func TestRetryWaitIsCapped(t *testing.T) {
+	savedPeriod, savedDuration := period, maxDuration
+	defer func() {
+		period, maxDuration = savedPeriod, savedDuration
+		atomic.StoreInt32(&retryCapWarned, 0)
+	}()
+
+	tests := []struct {
+		name          string
+		maxRetryAfter time.Duration
+		period        int64
+		maxDuration   time.Duration
+		header        string
+		want          time.Duration
+	}{
+		{"under the cap", time.Minute, -1, 0, "5", 5 * time.Second},
+		{"over the cap", time.Minute, -1, 0, "3600", time.Minute},
+		{"over the run", time.Minute, 10, 0, "30", 10 * time.Second},
+		{"over -max-duration", time.Minute, -1, 20 * time.Second, "30", 20 * time.Second},
+		{"no cap", 0, -1, 0, "3600", time.Hour},
+		{"no header", time.Minute, -1, 0, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			period, maxDuration = tt.period, tt.maxDuration
+			configuration := &Configuration{maxRetryAfter: tt.maxRetryAfter}
+			if got := retryWait(configuration, []byte(tt.header)); got != tt.want {
+				t.Errorf("waits %s on Retry-After %q, want %s", got, tt.header, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateRandFollowsTheClientRand(t *testing.T) {
+	tmpl, err := template.New("url").Funcs(templateFuncs(nil)).Parse("/items/{{rand 1000000}}/{{randInt 10 20}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(seed int64) string {
+		var out bytes.Buffer
+		r := rand.New(rand.NewSource(seed))
+		client := clientTemplate(tmpl, r)
+		for i := 0; i < 5; i++ {
+			if err := client.Execute(&out, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out.String()
+	}
+	if first, second := render(7), render(7); first != second {
+		t.Errorf("templates differ with the same seed: %s and %s", first, second)
+	}
+	if render(7) == render(8) {
+		t.Error("templates are the same with different seeds")
+	}
+}
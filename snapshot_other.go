@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// snapshotSignals is empty where there is no SIGUSR1, -snapshot-on-signal
+// only warns there
+var snapshotSignals []os.Signal
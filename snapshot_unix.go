@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// snapshotSignals print a summary of the run so far with -snapshot-on-signal
+var snapshotSignals = []os.Signal{syscall.SIGUSR1}